@@ -20,8 +20,10 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"math"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/minio/cli"
 	minfs "github.com/minio/minfs/fs"
@@ -107,10 +109,97 @@ func NewApp() *cli.App {
 					return errors.New("Cache has no value")
 				}
 				opts = append(opts, minfs.CacheDir(vals[1]))
+			case "cache_size":
+				if len(vals) == 1 {
+					return errors.New("Cache size has no value")
+				}
+				val, err := parseSize(vals[1])
+				if err != nil {
+					return fmt.Errorf("Cache size is not a valid value: %s", vals[1])
+				}
+				opts = append(opts, minfs.CacheSize(val))
+			case "readahead":
+				if len(vals) == 1 {
+					return errors.New("Readahead has no value")
+				}
+				val, err := parseSize(vals[1])
+				if err != nil {
+					return fmt.Errorf("Readahead is not a valid value: %s", vals[1])
+				}
+				opts = append(opts, minfs.Readahead(val))
 			case "insecure":
 				opts = append(opts, minfs.Insecure())
 			case "debug":
 				opts = append(opts, minfs.Debug())
+			case "stream_upload":
+				opts = append(opts, minfs.StreamUpload())
+			case "dir_ttl":
+				if len(vals) == 1 {
+					return errors.New("Directory ttl has no value")
+				}
+				val, err := time.ParseDuration(vals[1])
+				if err != nil {
+					return fmt.Errorf("Directory ttl is not a valid value: %s", vals[1])
+				}
+				opts = append(opts, minfs.DirTTL(val))
+			case "writeback":
+				opts = append(opts, minfs.WriteBack())
+			case "distributed_locks":
+				opts = append(opts, minfs.DistributedLocks())
+			case "upload_workers":
+				if len(vals) == 1 {
+					return errors.New("Upload workers has no value")
+				}
+				val, err := strconv.Atoi(vals[1])
+				if err != nil {
+					return fmt.Errorf("Upload workers is not a valid value: %s", vals[1])
+				}
+				opts = append(opts, minfs.UploadWorkers(val))
+			case "download_workers":
+				if len(vals) == 1 {
+					return errors.New("Download workers has no value")
+				}
+				val, err := strconv.Atoi(vals[1])
+				if err != nil {
+					return fmt.Errorf("Download workers is not a valid value: %s", vals[1])
+				}
+				opts = append(opts, minfs.DownloadWorkers(val))
+			case "max_open_files":
+				if len(vals) == 1 {
+					return errors.New("Max open files has no value")
+				}
+				val, err := strconv.Atoi(vals[1])
+				if err != nil {
+					return fmt.Errorf("Max open files is not a valid value: %s", vals[1])
+				}
+				opts = append(opts, minfs.MaxOpenFiles(val))
+			case "op_timeout":
+				if len(vals) == 1 {
+					return errors.New("Operation timeout has no value")
+				}
+				val, err := time.ParseDuration(vals[1])
+				if err != nil {
+					return fmt.Errorf("Operation timeout is not a valid value: %s", vals[1])
+				}
+				opts = append(opts, minfs.OperationTimeout(val))
+			case "retries":
+				if len(vals) == 1 {
+					return errors.New("Retries has no value")
+				}
+				val, err := strconv.Atoi(vals[1])
+				if err != nil {
+					return fmt.Errorf("Retries is not a valid value: %s", vals[1])
+				}
+				opts = append(opts, minfs.RetryAttempts(val))
+			case "retry_backoff":
+				if len(vals) == 1 {
+					return errors.New("Retry backoff has no value")
+				}
+				val, err := time.ParseDuration(vals[1])
+				if err != nil {
+					return fmt.Errorf("Retry backoff is not a valid value: %s", vals[1])
+				}
+				opts = append(opts, minfs.RetryBackoff(val))
 			}
 
 			target := c.Args().Get(0)
@@ -135,6 +224,28 @@ func NewApp() *cli.App {
 	return app
 }
 
+// parseSize parses a size with an optional binary unit suffix, e.g. 20G.
+func parseSize(s string) (int64, error) {
+	units := map[byte]uint{'K': 10, 'M': 20, 'G': 30, 'T': 40}
+
+	shift := uint(0)
+	if len(s) > 0 {
+		if n, ok := units[strings.ToUpper(s[len(s)-1:])[0]]; ok {
+			shift = n
+			s = s[:len(s)-1]
+		}
+	}
+
+	val, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if val < 0 || val > math.MaxInt64>>shift {
+		return 0, errors.New("Size out of range")
+	}
+	return val << shift, nil
+}
+
 // Main is the actual run function
 func Main(app *cli.App, args []string) {
 	// Enable profiling supported modes are [cpu, mem, block].
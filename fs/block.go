@@ -0,0 +1,150 @@
+// Copyright (c) 2021 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package minfs
+
+import (
+	"context"
+	"io"
+
+	"bazil.org/fuse"
+	"github.com/minio/minfs/meta"
+	minio "github.com/minio/minio-go/v7"
+)
+
+// blockSize is the unit in which objects are fetched by ranged reads.
+const blockSize = 1 << 20
+
+// blockRange returns the first and last block touching [offset, offset+size).
+func blockRange(offset, size int64) (first, last int64) {
+	if size <= 0 {
+		return offset / blockSize, offset/blockSize - 1
+	}
+	return offset / blockSize, (offset + size - 1) / blockSize
+}
+
+// fetchRange reads the bytes [start, end) of the remote object. Fewer bytes
+// are returned when the object is shorter than expected.
+func (f *File) fetchRange(ctx context.Context, start, end int64) ([]byte, error) {
+	opts := minio.GetObjectOptions{}
+	if err := opts.SetRange(start, end-1); err != nil {
+		return nil, err
+	}
+
+	// blocks are cached by ETag, never mix in a newer version
+	if f.ETag != "" {
+		if err := opts.SetMatchETag(f.ETag); err != nil {
+			return nil, err
+		}
+	}
+
+	var buf []byte
+	if err := f.mfs.retry(ctx, func() error {
+		object, err := f.mfs.api.GetObject(ctx, f.mfs.config.bucket, f.RemotePath(), opts)
+		if err != nil {
+			return err
+		}
+		defer object.Close()
+
+		buf = make([]byte, end-start)
+		n, err := io.ReadFull(object, buf)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			buf = buf[:n]
+			return nil
+		}
+		return err
+	}); err != nil {
+		if meta.IsNoSuchObject(err) {
+			return nil, fuse.ENOENT
+		} else if code := minio.ToErrorResponse(err).Code; code == "InvalidRange" {
+			// object shrunk since it was scanned
+			return nil, nil
+		} else if code == "PreconditionFailed" {
+			// object changed since it was opened
+			return nil, fuse.ESTALE
+		}
+		return nil, err
+	}
+
+	return buf, nil
+}
+
+// readBlocks reads [offset, offset+size) through the block cache, contiguous
+// missing blocks are fetched with a single request and added to the cache.
+func (fh *FileHandle) readBlocks(ctx context.Context, offset, size int64) ([]byte, error) {
+	cache := fh.f.mfs.cache
+
+	objectSize := int64(fh.f.Size)
+	if offset >= objectSize {
+		return nil, nil
+	} else if offset+size > objectSize {
+		size = objectSize - offset
+	}
+
+	first, last := blockRange(offset, size)
+
+	blocks := make([][]byte, last-first+1)
+	for idx := first; idx <= last; idx++ {
+		fh.waitPrefetch(ctx, idx)
+
+		if data, ok := cache.Get(fh.cacheKey, idx); ok {
+			blocks[idx-first] = data
+			continue
+		}
+
+		// coalesce the run of missing blocks
+		end := idx
+		for end < last && !cache.Contains(fh.cacheKey, end+1) {
+			end++
+		}
+
+		data, err := fh.f.fetchRange(ctx, idx*blockSize, (end+1)*blockSize)
+		if err != nil {
+			return nil, err
+		}
+
+		for ; idx <= end && len(data) > 0; idx++ {
+			n := blockSize
+			if n > len(data) {
+				n = len(data)
+			}
+
+			blocks[idx-first] = data[:n]
+			if err := cache.Put(fh.cacheKey, idx, data[:n]); err != nil {
+				fh.f.mfs.log.Println("Unable to cache block.", err)
+			}
+
+			data = data[n:]
+		}
+		idx = end
+	}
+
+	buf := make([]byte, 0, size)
+	for i, data := range blocks {
+		start := int64(0)
+		if i == 0 {
+			start = offset - first*blockSize
+		}
+		if start >= int64(len(data)) {
+			break
+		}
+		buf = append(buf, data[start:]...)
+	}
+
+	if int64(len(buf)) > size {
+		buf = buf[:size]
+	}
+	return buf, nil
+}
@@ -0,0 +1,226 @@
+// Copyright (c) 2021 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package minfs
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// blockCache is a persistent cache of object blocks on local disk. Blocks are
+// keyed by object path and ETag, so a changed object never returns stale
+// data, and the least recently used blocks are evicted when the cache
+// exceeds its maximum size.
+type blockCache struct {
+	dir     string
+	maxSize int64
+
+	m     sync.Mutex
+	size  int64
+	lru   *list.List
+	items map[string]*list.Element
+}
+
+type cacheEntry struct {
+	name string
+	size int64
+}
+
+// newBlockCache opens the block cache at dir, the blocks already on disk are
+// ordered by their modification time.
+func newBlockCache(dir string, maxSize int64) (*blockCache, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	c := &blockCache{
+		dir:     dir,
+		maxSize: maxSize,
+		lru:     list.New(),
+		items:   map[string]*list.Element{},
+	}
+
+	type block struct {
+		name    string
+		size    int64
+		modTime time.Time
+	}
+
+	var blocks []block
+	if err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if fi.IsDir() {
+			return nil
+		}
+
+		name, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+
+		// remove leftovers of interrupted writes
+		if strings.HasSuffix(name, ".tmp") {
+			return os.Remove(p)
+		}
+
+		blocks = append(blocks, block{name, fi.Size(), fi.ModTime()})
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(blocks, func(i, j int) bool {
+		return blocks[i].modTime.Before(blocks[j].modTime)
+	})
+
+	for _, b := range blocks {
+		c.items[b.name] = c.lru.PushFront(&cacheEntry{b.name, b.size})
+		c.size += b.size
+	}
+
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	c.evict()
+	return c, nil
+}
+
+// cacheKey returns the key of an object version in the block cache.
+func cacheKey(objectPath, etag string) string {
+	sum := sha256.Sum256([]byte(objectPath + "\x00" + etag))
+	return hex.EncodeToString(sum[:])
+}
+
+func blockName(key string, idx int64) string {
+	return filepath.Join(key[:2], key, strconv.FormatInt(idx, 10))
+}
+
+// Contains returns if the block idx of the object key is cached.
+func (c *blockCache) Contains(key string, idx int64) bool {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	_, ok := c.items[blockName(key, idx)]
+	return ok
+}
+
+// Get returns the block idx of the object key, if cached.
+func (c *blockCache) Get(key string, idx int64) ([]byte, bool) {
+	name := blockName(key, idx)
+
+	c.m.Lock()
+	e, ok := c.items[name]
+	if ok {
+		c.lru.MoveToFront(e)
+	}
+	c.m.Unlock()
+
+	if !ok {
+		return nil, false
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(c.dir, name))
+	if err != nil {
+		c.remove(name)
+		return nil, false
+	}
+
+	// keep the recency across restarts
+	now := time.Now()
+	os.Chtimes(filepath.Join(c.dir, name), now, now)
+
+	return data, true
+}
+
+// Put stores the block idx of the object key and evicts the least recently
+// used blocks when the cache is full.
+func (c *blockCache) Put(key string, idx int64, data []byte) error {
+	name := blockName(key, idx)
+
+	p := filepath.Join(c.dir, name)
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return err
+	}
+
+	tmp := p + "." + nextSuffix() + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := os.Rename(tmp, p); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if e, ok := c.items[name]; ok {
+		entry := e.Value.(*cacheEntry)
+		c.size -= entry.size
+		entry.size = int64(len(data))
+		c.lru.MoveToFront(e)
+	} else {
+		c.items[name] = c.lru.PushFront(&cacheEntry{name, int64(len(data))})
+	}
+	c.size += int64(len(data))
+
+	c.evict()
+	return nil
+}
+
+func (c *blockCache) remove(name string) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if e, ok := c.items[name]; ok {
+		c.removeElement(e)
+	}
+}
+
+// evict removes the least recently used blocks till the cache fits, the
+// caller must hold the lock.
+func (c *blockCache) evict() {
+	for c.size > c.maxSize && c.lru.Len() > 0 {
+		c.removeElement(c.lru.Back())
+	}
+}
+
+func (c *blockCache) removeElement(e *list.Element) {
+	entry := e.Value.(*cacheEntry)
+
+	c.lru.Remove(e)
+	delete(c.items, entry.name)
+	c.size -= entry.size
+
+	p := filepath.Join(c.dir, entry.name)
+	os.Remove(p)
+	// remove the object directory once its last block is gone
+	os.Remove(filepath.Dir(p))
+}
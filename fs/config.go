@@ -24,6 +24,7 @@ import (
 	"os"
 	"path"
 	"strings"
+	"time"
 )
 
 // Config is being used for storge of configuration items
@@ -32,6 +33,8 @@ type Config struct {
 	basePath string
 
 	cache       string
+	cacheSize   int64
+	readahead   int64
 	accountID   string
 	accessKey   string
 	secretKey   string
@@ -41,6 +44,38 @@ type Config struct {
 	insecure    bool
 	debug       bool
 
+	// stream sequentially written files with multipart uploads
+	streamUpload bool
+
+	// upload closed files in the background
+	writeback bool
+
+	// lock files across mounts with leases in the bucket
+	distributedLocks bool
+
+	// number of concurrent sync operations
+	uploadWorkers int
+
+	// number of concurrent ranged requests downloading a file, one
+	// downloads with a single request.
+	downloadWorkers int
+
+	// maximum number of open file handles, zero is unlimited
+	maxOpenFiles int
+
+	// sync operations are aborted after this duration, zero waits
+	// till they finish.
+	opTimeout time.Duration
+
+	// transient errors of S3 calls are retried up to retryAttempts
+	// attempts in total, starting with retryBackoff between attempts.
+	retryAttempts int
+	retryBackoff  time.Duration
+
+	// directories are rescanned and attributes revalidated by the kernel
+	// after this duration, zero scans directories only once.
+	dirTTL time.Duration
+
 	uid  uint32
 	gid  uint32
 	mode os.FileMode
@@ -138,6 +173,66 @@ func CacheDir(path string) func(*Config) {
 	}
 }
 
+// CacheSize - maximum size of the block cache option for Config
+func CacheSize(size int64) func(*Config) {
+	return func(cfg *Config) {
+		cfg.cacheSize = size
+	}
+}
+
+// Readahead - size of the window prefetched ahead of sequential reads, zero
+// disables readahead.
+func Readahead(size int64) func(*Config) {
+	return func(cfg *Config) {
+		cfg.readahead = size
+	}
+}
+
+// UploadWorkers - number of concurrent uploads, copies and moves.
+func UploadWorkers(n int) func(*Config) {
+	return func(cfg *Config) {
+		cfg.uploadWorkers = n
+	}
+}
+
+// DownloadWorkers - number of concurrent ranged requests downloading a file.
+func DownloadWorkers(n int) func(*Config) {
+	return func(cfg *Config) {
+		cfg.downloadWorkers = n
+	}
+}
+
+// MaxOpenFiles - limits the number of open file handles.
+func MaxOpenFiles(n int) func(*Config) {
+	return func(cfg *Config) {
+		cfg.maxOpenFiles = n
+	}
+}
+
+// OperationTimeout - sets the time after which uploads, copies and moves are
+// aborted.
+func OperationTimeout(timeout time.Duration) func(*Config) {
+	return func(cfg *Config) {
+		cfg.opTimeout = timeout
+	}
+}
+
+// RetryAttempts - sets the number of attempts of S3 calls failing with
+// transient errors.
+func RetryAttempts(attempts int) func(*Config) {
+	return func(cfg *Config) {
+		cfg.retryAttempts = attempts
+	}
+}
+
+// RetryBackoff - sets the initial delay between attempts, it doubles with
+// every attempt.
+func RetryBackoff(backoff time.Duration) func(*Config) {
+	return func(cfg *Config) {
+		cfg.retryBackoff = backoff
+	}
+}
+
 // SetGID - sets a custom gid for the mount.
 func SetGID(gid uint32) func(*Config) {
 	return func(cfg *Config) {
@@ -159,6 +254,34 @@ func Insecure() func(*Config) {
 	}
 }
 
+// StreamUpload - enables streaming uploads of sequentially written files.
+func StreamUpload() func(*Config) {
+	return func(cfg *Config) {
+		cfg.streamUpload = true
+	}
+}
+
+// WriteBack - enables uploading closed files in the background.
+func WriteBack() func(*Config) {
+	return func(cfg *Config) {
+		cfg.writeback = true
+	}
+}
+
+// DistributedLocks - enables locking files across mounts of the bucket.
+func DistributedLocks() func(*Config) {
+	return func(cfg *Config) {
+		cfg.distributedLocks = true
+	}
+}
+
+// DirTTL - sets the time after which directories are rescanned.
+func DirTTL(ttl time.Duration) func(*Config) {
+	return func(cfg *Config) {
+		cfg.dirTTL = ttl
+	}
+}
+
 // Debug - enables debug logging.
 func Debug() func(*Config) {
 	return func(cfg *Config) {
@@ -181,5 +304,41 @@ func (cfg *Config) validate() error {
 		return errors.New("Bucket not set")
 	}
 
+	if cfg.dirTTL < 0 {
+		return errors.New("Directory ttl is negative")
+	}
+
+	if cfg.cacheSize < 0 {
+		return errors.New("Cache size is negative")
+	}
+
+	if cfg.readahead < 0 {
+		return errors.New("Readahead is negative")
+	}
+
+	if cfg.opTimeout < 0 {
+		return errors.New("Operation timeout is negative")
+	}
+
+	if cfg.retryAttempts < 1 {
+		return errors.New("Retry attempts must be at least one")
+	}
+
+	if cfg.retryBackoff < 0 {
+		return errors.New("Retry backoff is negative")
+	}
+
+	if cfg.uploadWorkers < 1 {
+		return errors.New("Upload workers must be at least one")
+	}
+
+	if cfg.downloadWorkers < 1 {
+		return errors.New("Download workers must be at least one")
+	}
+
+	if cfg.maxOpenFiles < 0 {
+		return errors.New("Max open files is negative")
+	}
+
 	return nil
 }
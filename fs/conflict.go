@@ -0,0 +1,71 @@
+// Copyright (c) 2021 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package minfs
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/minio/minfs/meta"
+	minio "github.com/minio/minio-go/v7"
+)
+
+// conflictName returns the name our version of target is uploaded to when
+// the object has been changed by someone else in the meantime.
+func conflictName(target string) string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	return fmt.Sprintf("%s.conflict-%s-%s", target, hostname, time.Now().UTC().Format("20060102T150405Z"))
+}
+
+// currentObject returns the info of the object, nil if it doesn't exist.
+func (mfs *MinFS) currentObject(ctx context.Context, object string) (*minio.ObjectInfo, error) {
+	objInfo, err := mfs.statObject(ctx, object)
+	if meta.IsNoSuchObject(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &objInfo, nil
+}
+
+// conflicting returns if the current object no longer has the ETag it was
+// opened with, an empty etag expects no object. Objects removed in the
+// meantime are recreated.
+func conflicting(current *minio.ObjectInfo, etag string) bool {
+	return current != nil && current.ETag != etag
+}
+
+// written advances the handles of target, which were opened with the ETag
+// from, to the ETag of a copy or background upload of this mount, so these
+// writes are not taken as conflicts.
+func (mfs *MinFS) written(target, from, to string) {
+	for _, fh := range mfs.handles.list() {
+		if fh.f.RemotePath() != target {
+			continue
+		}
+
+		fh.m.Lock()
+		if fh.etag == from {
+			fh.etag = to
+		}
+		fh.m.Unlock()
+	}
+}
@@ -20,6 +20,7 @@ import (
 	"os"
 	"path"
 	"strings"
+	"sync"
 	"time"
 
 	"bazil.org/fuse"
@@ -54,11 +55,18 @@ type Dir struct {
 	Crtime   time.Time
 	Flags    uint32 // see chflags(2)
 
-	scanned bool
+	// time of the last scan, the directory is rescanned once it is older
+	// than the configured ttl.
+	scanned time.Time
 }
 
 func (dir *Dir) needsScan() bool {
-	return !dir.scanned
+	if dir.scanned.IsZero() {
+		return true
+	}
+
+	ttl := dir.mfs.config.dirTTL
+	return ttl > 0 && time.Since(dir.scanned) > ttl
 }
 
 // Attr returns the attributes for the directory
@@ -74,17 +82,25 @@ func (dir *Dir) Attr(ctx context.Context, a *fuse.Attr) error {
 		Uid:    dir.UID,
 		Gid:    dir.GID,
 		Flags:  dir.Flags,
+		Valid:  dir.mfs.config.dirTTL,
 	}
 
 	return nil
 }
 
 // Lookup returns the file node, and scans the current dir if necessary
-func (dir *Dir) Lookup(ctx context.Context, name string) (fs.Node, error) {
+func (dir *Dir) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.LookupResponse) (fs.Node, error) {
 	if err := dir.scan(ctx); err != nil {
 		return nil, err
 	}
 
+	name := req.Name
+
+	// the kernel revalidates the entry once the directory expires
+	if ttl := dir.mfs.config.dirTTL; ttl > 0 {
+		resp.EntryValid = ttl
+	}
+
 	// we are not statting each object here because of performance reasons
 	var o interface{} // meta.Object
 	if err := dir.mfs.db.View(func(tx *meta.Tx) error {
@@ -104,12 +120,27 @@ func (dir *Dir) Lookup(ctx context.Context, name string) (fs.Node, error) {
 	} else if subdir, ok := o.(Dir); ok {
 		subdir.mfs = dir.mfs
 		subdir.dir = dir
+		dir.mfs.registerDir(&subdir)
 		return &subdir, nil
+	} else if link, ok := o.(Symlink); ok {
+		link.mfs = dir.mfs
+		link.dir = dir
+		return &link, nil
 	}
 
 	return nil, fuse.ENOENT
 }
 
+// Forget is called when the kernel drops the directory node.
+func (dir *Dir) Forget() {
+	dir.mfs.m.Lock()
+	defer dir.mfs.m.Unlock()
+
+	if dir.mfs.nodes[dir.Inode] == dir {
+		delete(dir.mfs.nodes, dir.Inode)
+	}
+}
+
 // RemotePath returns the full path including parent paths for current dir on the remote
 func (dir *Dir) RemotePath() string {
 	return path.Join(dir.mfs.config.basePath, dir.FullPath())
@@ -154,6 +185,9 @@ func (dir *Dir) storeFile(bucket *meta.Bucket, tx *meta.Tx, baseKey string, objI
 		if objInfo.LastModified.After(f.Atime) {
 			f.Atime = objInfo.LastModified
 		}
+		f.applyUserMetadata(objInfo.UserMetadata)
+		f.Unread = objInfo.UserMetadata == nil
+		err = f.store(tx)
 	} else if meta.IsNoSuchObject(err) {
 		// Object not found, allocate a new inode.
 		var seq uint64
@@ -174,7 +208,9 @@ func (dir *Dir) storeFile(bucket *meta.Bucket, tx *meta.Tx, baseKey string, objI
 			Mtime:   objInfo.LastModified,
 			Atime:   objInfo.LastModified,
 			ETag:    objInfo.ETag,
+			Unread:  objInfo.UserMetadata == nil,
 		}
+		f.applyUserMetadata(objInfo.UserMetadata)
 		if err = f.store(tx); err != nil {
 			return err
 		}
@@ -223,6 +259,37 @@ func (dir *Dir) scan(ctx context.Context) error {
 		return nil
 	}
 
+	prefix := dir.RemotePath()
+	if prefix != "" {
+		prefix = prefix + "/"
+	}
+
+	var infos []minio.ObjectInfo
+
+	// POSIX attributes are stored in the user metadata
+	if err := dir.mfs.listObjects(ctx, minio.ListObjectsOptions{
+		Prefix:       prefix,
+		Recursive:    false,
+		WithMetadata: true,
+	}, func(objInfo minio.ObjectInfo) error {
+		key := objInfo.Key[len(prefix):]
+
+		// the marker object of this directory
+		if key == "" || dir.mfs.internalObject(objInfo.Key) {
+			return nil
+		}
+
+		infos = append(infos, objInfo)
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	unchanged, err := dir.statObjects(ctx, infos)
+	if err != nil {
+		return err
+	}
+
 	tx, err := dir.mfs.db.Begin(true)
 	if err != nil {
 		return err
@@ -244,17 +311,7 @@ func (dir *Dir) scan(ctx context.Context) error {
 		return err
 	}
 
-	prefix := dir.RemotePath()
-	if prefix != "" {
-		prefix = prefix + "/"
-	}
-
-	ch := dir.mfs.api.ListObjects(ctx, dir.mfs.config.bucket, minio.ListObjectsOptions{
-		Prefix:    prefix,
-		Recursive: false,
-	})
-
-	for objInfo := range ch {
+	for _, objInfo := range infos {
 		key := objInfo.Key[len(prefix):]
 		baseKey := path.Base(key)
 
@@ -263,6 +320,11 @@ func (dir *Dir) scan(ctx context.Context) error {
 
 		if strings.HasSuffix(key, "/") {
 			dir.storeDir(b, tx, baseKey, objInfo)
+		} else if unchanged[baseKey] {
+			// keep the cached attributes
+			continue
+		} else if target, ok := symlinkTarget(objInfo.UserMetadata); ok {
+			dir.storeSymlink(b, tx, baseKey, target, objInfo)
 		} else {
 			dir.storeFile(b, tx, baseKey, objInfo)
 		}
@@ -274,6 +336,11 @@ func (dir *Dir) scan(ctx context.Context) error {
 			continue
 		}
 
+		// not uploaded yet in write-back mode
+		if _, ok := lookupPending(tx, path.Join(dir.RemotePath(), k)); ok {
+			continue
+		}
+
 		// purge from cache
 		b.Delete(k)
 
@@ -288,10 +355,106 @@ func (dir *Dir) scan(ctx context.Context) error {
 		return err
 	}
 
-	dir.scanned = true
+	dir.scanned = time.Now()
 	return nil
 }
 
+// Objects listed without their user metadata are read back with up to
+// statWorkers concurrent stats, at most maxScanStats per scan. The remaining
+// ones are stored as unread and read back by the next scans.
+const (
+	statWorkers  = 16
+	maxScanStats = 1024
+)
+
+// statObjects reads the user metadata of the listed objects which the
+// listing came without, only servers supporting the metadata extension of
+// MinIO include it. Objects cached with the same ETag are left to their
+// cached attributes and returned as unchanged.
+func (dir *Dir) statObjects(ctx context.Context, infos []minio.ObjectInfo) (map[string]bool, error) {
+	etags := map[string]string{}
+	if err := dir.mfs.db.View(func(tx *meta.Tx) error {
+		return dir.bucket(tx).ForEach(func(k string, o interface{}) error {
+			if f, ok := o.(File); ok && !f.Unread {
+				etags[k] = f.ETag
+			} else if l, ok := o.(Symlink); ok {
+				etags[k] = l.ETag
+			}
+			return nil
+		})
+	}); err != nil {
+		return nil, err
+	}
+
+	unchanged := map[string]bool{}
+
+	var todo []int
+	for i := range infos {
+		if infos[i].UserMetadata != nil || strings.HasSuffix(infos[i].Key, "/") {
+			continue
+		}
+
+		baseKey := path.Base(infos[i].Key)
+		if etag, ok := etags[baseKey]; ok && etag == infos[i].ETag {
+			unchanged[baseKey] = true
+			continue
+		}
+
+		todo = append(todo, i)
+	}
+
+	if len(todo) > maxScanStats {
+		todo = todo[:maxScanStats]
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	idxCh := make(chan int)
+	errCh := make(chan error, statWorkers)
+
+	var wg sync.WaitGroup
+	for i := 0; i < statWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for i := range idxCh {
+				objInfo, err := dir.mfs.statObject(ctx, infos[i].Key)
+				if meta.IsNoSuchObject(err) {
+					// removed since the listing, stored without metadata
+					continue
+				} else if err != nil {
+					errCh <- err
+					cancel()
+					return
+				}
+				infos[i].UserMetadata = objInfo.UserMetadata
+			}
+		}()
+	}
+
+loop:
+	for _, i := range todo {
+		select {
+		case idxCh <- i:
+		case <-ctx.Done():
+			break loop
+		}
+	}
+
+	close(idxCh)
+	wg.Wait()
+
+	select {
+	case err := <-errCh:
+		return nil, err
+	default:
+	}
+
+	return unchanged, ctx.Err()
+}
+
 // ReadDirAll will return all files in current dir
 func (dir *Dir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
 	if err := dir.scan(ctx); err != nil {
@@ -309,6 +472,8 @@ func (dir *Dir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
 			} else if subdir, ok := o.(Dir); ok {
 				subdir.dir = dir
 				entries = append(entries, subdir.Dirent())
+			} else if link, ok := o.(Symlink); ok {
+				entries = append(entries, link.Dirent())
 			} else {
 				panic("Could not find type. Try to remove cache.")
 			}
@@ -351,22 +516,28 @@ func (dir *Dir) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fs.Node, err
 		Atime:   time.Now(),
 	}
 
-	tx, err := dir.mfs.db.Begin(true)
-	if err != nil {
-		return nil, err
-	}
-
-	defer tx.Rollback()
-
-	if err := subdir.store(tx); err != nil {
+	// empty directories only exist in the bucket by their marker object,
+	// it is created before the transaction as it takes requests to the
+	// bucket.
+	if err := dir.mfs.retry(ctx, func() error {
+		_, err := dir.mfs.api.PutObject(ctx, dir.mfs.config.bucket, subdir.RemotePath()+"/", strings.NewReader(""), 0, minio.PutObjectOptions{})
+		return err
+	}); err != nil {
 		return nil, err
 	}
 
-	// Commit the transaction and check for error.
-	if err := tx.Commit(); err != nil {
+	if err := dir.mfs.db.Update(func(tx *meta.Tx) (err error) {
+		// inodes identify the directory towards the kernel
+		if subdir.Inode, err = dir.mfs.NextSequence(tx); err != nil {
+			return err
+		}
+		return subdir.store(tx)
+	}); err != nil {
+		dir.mfs.undoObject(subdir.RemotePath() + "/")
 		return nil, err
 	}
 
+	dir.mfs.registerDir(&subdir)
 	return &subdir, nil
 }
 
@@ -376,33 +547,56 @@ func (dir *Dir) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
 		return err
 	}
 
-	tx, err := dir.mfs.db.Begin(true)
-	if err != nil {
+	if err := dir.mfs.db.View(func(tx *meta.Tx) error {
+		var o interface{}
+		if err := dir.bucket(tx).Get(req.Name, &o); meta.IsNoSuchObject(err) {
+			return fuse.ENOENT
+		} else if err != nil {
+			return err
+		}
+		return nil
+	}); err != nil {
 		return err
 	}
 
-	defer tx.Rollback()
+	if req.Dir {
+		if err := dir.mfs.checkEmpty(ctx, path.Join(dir.RemotePath(), req.Name)); err != nil {
+			return err
+		}
+	}
 
-	b := dir.bucket(tx)
+	objectName := path.Join(dir.RemotePath(), req.Name)
+	if req.Dir {
+		// the marker object, implicit directories have none
+		objectName += "/"
+	}
 
-	var o interface{}
-	if err := b.Get(req.Name, &o); meta.IsNoSuchObject(err) {
-		return fuse.ENOENT
-	} else if err != nil {
-		return err
-	} else if err := b.Delete(req.Name); err != nil {
+	// the object is removed before the transaction as it takes requests
+	// to the bucket.
+	if err := dir.mfs.removeObject(ctx, objectName); err != nil {
 		return err
 	}
 
-	if req.Dir {
-		b.DeleteBucket(req.Name + "/")
-	}
+	var dropped []string
+	if err := dir.mfs.db.Update(func(tx *meta.Tx) (err error) {
+		b := dir.bucket(tx)
+		if err := b.Delete(req.Name); err != nil {
+			return err
+		}
 
-	if err := dir.mfs.api.RemoveObject(ctx, dir.mfs.config.bucket, path.Join(dir.RemotePath(), req.Name), minio.RemoveObjectOptions{}); err != nil {
+		if req.Dir {
+			b.DeleteBucket(req.Name + "/")
+			dropped, err = dir.mfs.dropPendingBelow(writebackBucket(tx), path.Join(dir.RemotePath(), req.Name))
+		} else {
+			dropped, err = dir.mfs.dropPending(writebackBucket(tx), path.Join(dir.RemotePath(), req.Name))
+		}
+		return err
+	}); err != nil {
 		return err
 	}
 
-	return tx.Commit()
+	removeStaged(dropped)
+	return nil
 }
 
 // store the dir object in cache
@@ -427,11 +621,59 @@ func (dir *Dir) Dirent() fuse.Dirent {
 
 // Create will return a new empty file in current dir, if the file is currently locked, it will
 // wait for the lock to be freed.
-func (dir *Dir) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.CreateResponse) (fs.Node, fs.Handle, error) {
+func (dir *Dir) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.CreateResponse) (n fs.Node, h fs.Handle, err error) {
 	if err := dir.mfs.wait(path.Join(dir.FullPath(), req.Name)); err != nil {
 		return nil, nil, err
 	}
 
+	exclusive := req.Flags&fuse.OpenExclusive == fuse.OpenExclusive
+	truncate := req.Flags&fuse.OpenTruncate == fuse.OpenTruncate
+
+	var f File
+	exists := dir.mfs.db.View(func(tx *meta.Tx) error {
+		return dir.bucket(tx).Get(req.Name, &f)
+	}) == nil
+
+	if exists && exclusive {
+		return nil, nil, fuse.EEXIST
+	} else if exists && !truncate {
+		// existing files keep their content, like with open(2)
+		f.mfs = dir.mfs
+		f.dir = dir
+
+		if h, err = f.Open(ctx, &fuse.OpenRequest{Header: req.Header, Flags: req.Flags}, &resp.OpenResponse); err != nil {
+			return nil, nil, err
+		}
+		return &f, h, nil
+	} else if exclusive {
+		// the object may have been created by another client since
+		// the directory was scanned
+		if _, err := dir.mfs.statObject(ctx, path.Join(dir.RemotePath(), req.Name)); err == nil {
+			return nil, nil, fuse.EEXIST
+		} else if !meta.IsNoSuchObject(err) {
+			return nil, nil, err
+		}
+	}
+
+	// the lease is taken before the transaction as it takes requests to
+	// the bucket.
+	fullPath := path.Join(dir.FullPath(), req.Name)
+	if err = dir.mfs.acquireLease(fullPath); err != nil {
+		return nil, nil, err
+	}
+
+	var fh *FileHandle
+	defer func() {
+		if err == nil {
+			return
+		}
+		if fh != nil {
+			dir.mfs.Release(fh)
+		} else {
+			dir.mfs.releaseLease(fullPath)
+		}
+	}()
+
 	tx, err := dir.mfs.db.Begin(true)
 	if err != nil {
 		return nil, nil, err
@@ -443,10 +685,12 @@ func (dir *Dir) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.
 
 	name := req.Name
 
-	var f File
 	if gerr := b.Get(name, &f); gerr == nil {
 		f.mfs = dir.mfs
 		f.dir = dir
+
+		// truncated
+		f.Size = 0
 	} else if i, nerr := dir.mfs.NextSequence(tx); nerr != nil {
 		return nil, nil, nerr
 	} else {
@@ -474,17 +718,21 @@ func (dir *Dir) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.
 		return nil, nil, serr
 	}
 
-	var fh *FileHandle
 	if fh, err = dir.mfs.Acquire(&f); err != nil {
 		return nil, nil, err
 	}
+	fh.leased = true
 	fh.dirty = true
+	fh.base = 0
+	fh.sequential = dir.mfs.config.streamUpload
 	if fh.cachePath, err = dir.mfs.NewCachePath(); err != nil {
 		return nil, nil, err
 	}
-	if fh.File, err = os.OpenFile(fh.cachePath, int(req.Flags), dir.mfs.config.mode); err != nil {
+	fh.append = req.Flags&fuse.OpenAppend == fuse.OpenAppend
+	if fh.File, err = os.OpenFile(fh.cachePath, int(req.Flags&^fuse.OpenAppend), dir.mfs.config.mode); err != nil {
 		return nil, nil, err
 	}
+	fh.writable = !req.Flags.IsReadOnly()
 
 	// Commit the transaction and check for error.
 	if err = tx.Commit(); err != nil {
@@ -524,7 +772,13 @@ func (dir *Dir) Rename(ctx context.Context, req *fuse.RenameRequest, nd fs.Node)
 		file.dir = newDir
 		file.mfs = dir.mfs
 
-		sr := newMoveOp(oldPath, file.RemotePath())
+		// pending uploads follow the file to its new name
+		pending, err := dir.mfs.retargetPending(tx, oldPath, file.RemotePath())
+		if err != nil {
+			return err
+		}
+
+		sr := newMoveOp(ctx, oldPath, file.RemotePath())
 		if err := dir.mfs.sync(&sr); err == nil {
 		} else if meta.IsNoSuchObject(err) {
 			return fuse.ENOENT
@@ -533,8 +787,8 @@ func (dir *Dir) Rename(ctx context.Context, req *fuse.RenameRequest, nd fs.Node)
 		}
 
 		// we'll wait for the request to be uploaded and synced, before
-		// releasing the file
-		if err := <-sr.Error; err != nil {
+		// releasing the file, files never uploaded have nothing to move.
+		if err := sr.wait(); err != nil && !(pending && meta.IsNoSuchObject(err)) {
 			return err
 		}
 
@@ -542,10 +796,39 @@ func (dir *Dir) Rename(ctx context.Context, req *fuse.RenameRequest, nd fs.Node)
 			return err
 		}
 
+	} else if link, ok := o.(Symlink); ok {
+		link.dir = dir
+
+		if err := b.Delete(link.Path); err != nil {
+			return err
+		}
+
+		oldPath := link.RemotePath()
+
+		link.Path = req.NewName
+		link.dir = newDir
+		link.mfs = dir.mfs
+
+		// the target is carried over with the user metadata
+		sr := newMoveOp(ctx, oldPath, link.RemotePath())
+		if err := dir.mfs.sync(&sr); err != nil {
+			return err
+		}
+
+		if err := sr.wait(); meta.IsNoSuchObject(err) {
+			return fuse.ENOENT
+		} else if err != nil {
+			return err
+		}
+
+		if err := link.store(tx); err != nil {
+			return err
+		}
+
 	} else if subdir, ok := o.(Dir); ok {
 		// rescan in case of abort / partial / failure
 		// this will repair the cache
-		dir.scanned = false
+		dir.scanned = time.Time{}
 
 		if err := b.Delete(req.OldName); err != nil {
 			return err
@@ -555,7 +838,7 @@ func (dir *Dir) Rename(ctx context.Context, req *fuse.RenameRequest, nd fs.Node)
 			return err
 		}
 
-		newDir.scanned = false
+		newDir.scanned = time.Time{}
 
 		// fusebug?
 		// the cached node is still invalid, contains the old name
@@ -572,30 +855,30 @@ func (dir *Dir) Rename(ctx context.Context, req *fuse.RenameRequest, nd fs.Node)
 			return err
 		}
 
-		oldPath := path.Join(dir.RemotePath(), req.OldName)
-
-		ch := dir.mfs.api.ListObjects(ctx, dir.mfs.config.bucket, minio.ListObjectsOptions{
-			Prefix:    oldPath + "/",
-			Recursive: true,
-		})
+		// the rename is journaled with the cache update, the objects
+		// are moved once the transaction has been committed.
+		id, err := dir.mfs.journalRename(tx, path.Join(dir.RemotePath(), req.OldName), path.Join(newDir.RemotePath(), req.NewName))
+		if err != nil {
+			return err
+		}
 
-		for message := range ch {
-			newPath := path.Join(newDir.RemotePath(), req.NewName, message.Key[len(oldPath):])
+		if err := tx.Commit(); err != nil {
+			return err
+		}
 
-			sr := newMoveOp(message.Key, newPath)
-			if err := dir.mfs.sync(&sr); err == nil {
-			} else if meta.IsNoSuchObject(err) {
-				return fuse.ENOENT
-			} else if err != nil {
+		// the rename is journaled and rolled forward, the remaining
+		// objects are moved in the background after transient errors.
+		if err := dir.mfs.runRename(ctx, id); err != nil {
+			if !renameRetryable(ctx, err) {
+				dir.mfs.log.Printf("Rename of %s failed, journal %s is kept: %s.\n", req.OldName, id, err)
 				return err
 			}
 
-			// we'll wait for the request to be uploaded and synced, before
-			// releasing the file
-			if err := <-sr.Error; err != nil {
-				return err
-			}
+			dir.mfs.log.Printf("Rename of %s continues in the background: %s.\n", req.OldName, err)
+			go dir.mfs.retryRename(id)
 		}
+
+		return nil
 	} else {
 		return fuse.ENOSYS
 	}
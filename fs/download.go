@@ -0,0 +1,101 @@
+// Copyright (c) 2021 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package minfs
+
+import (
+	"context"
+	"os"
+	"sync"
+)
+
+// downloadPartSize is the size of the ranges objects are downloaded in
+// concurrently.
+const downloadPartSize = 8 * blockSize
+
+// parallelDownload returns if the object is downloaded with concurrent
+// ranged requests, only versions pinned by ETag can be assembled safely.
+func (f *File) parallelDownload() bool {
+	return f.ETag != "" && f.mfs.config.downloadWorkers > 1 && int64(f.Size) > downloadPartSize
+}
+
+// downloadParts downloads the object with concurrent ranged requests, each
+// written to its offset in file. It returns the size of the object.
+func (f *File) downloadParts(ctx context.Context, file *os.File) (int64, error) {
+	mfs := f.mfs
+
+	parent := ctx
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	workers := mfs.config.downloadWorkers
+
+	partCh := make(chan int64)
+	errCh := make(chan error, workers)
+
+	var m sync.Mutex
+	var size int64
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for offset := range partCh {
+				data, err := f.fetchRange(ctx, offset, offset+downloadPartSize)
+				if err == nil {
+					_, err = file.WriteAt(data, offset)
+				}
+				if err != nil {
+					errCh <- err
+					cancel()
+					return
+				}
+
+				m.Lock()
+				if end := offset + int64(len(data)); end > size {
+					size = end
+				}
+				m.Unlock()
+			}
+		}()
+	}
+
+loop:
+	for offset := int64(0); offset < int64(f.Size); offset += downloadPartSize {
+		select {
+		case partCh <- offset:
+		case <-ctx.Done():
+			break loop
+		}
+	}
+
+	close(partCh)
+	wg.Wait()
+
+	// the first error is the one that canceled the other parts
+	select {
+	case err := <-errCh:
+		return 0, ctxErrno(parent, errno(err))
+	default:
+	}
+
+	if err := ctx.Err(); err != nil {
+		return 0, ctxErrno(parent, err)
+	}
+
+	return size, nil
+}
@@ -57,6 +57,13 @@ type File struct {
 	Flags    uint32 // see chflags(2)
 
 	Hash []byte
+
+	// user metadata and tags set before the object has been uploaded
+	Metadata map[string]string
+	Tags     map[string]string
+
+	// listed without its user metadata, which is read back by a later scan
+	Unread bool
 }
 
 func (f *File) store(tx *meta.Tx) error {
@@ -77,6 +84,7 @@ func (f *File) Attr(ctx context.Context, a *fuse.Attr) error {
 		Uid:    f.UID,
 		Gid:    f.GID,
 		Flags:  f.Flags,
+		Valid:  f.mfs.config.dirTTL,
 	}
 
 	return nil
@@ -84,8 +92,14 @@ func (f *File) Attr(ctx context.Context, a *fuse.Attr) error {
 
 // Setattr - set attribute.
 func (f *File) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
+	if req.Valid.Size() {
+		if err := f.truncate(ctx, req); err != nil {
+			return err
+		}
+	}
+
 	// update cache with new attributes
-	return f.mfs.db.Update(func(tx *meta.Tx) error {
+	if err := f.mfs.db.Update(func(tx *meta.Tx) error {
 		if req.Valid.Mode() {
 			f.Mode = req.Mode
 		}
@@ -127,7 +141,16 @@ func (f *File) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse
 		}
 
 		return f.store(tx)
-	})
+	}); err != nil {
+		return err
+	}
+
+	// attributes persisted in the object metadata
+	if req.Valid.Mode() || req.Valid.Uid() || req.Valid.Gid() || req.Valid.Atime() || req.Valid.Mtime() {
+		return f.storeMetadata(ctx)
+	}
+
+	return nil
 }
 
 // RemotePath will return the full path on bucket
@@ -140,8 +163,61 @@ func (f *File) FullPath() string {
 	return path.Join(f.dir.FullPath(), f.Path)
 }
 
+// revalidate compares the cached ETag with the remote object, and updates
+// the cached attributes when the object has been changed by another client.
+func (f *File) revalidate(ctx context.Context) (changed bool, err error) {
+	objInfo, err := f.mfs.statObject(ctx, f.RemotePath())
+	if err != nil {
+		if meta.IsNoSuchObject(err) {
+			return false, fuse.ENOENT
+		}
+		return false, err
+	}
+
+	if objInfo.ETag == f.ETag {
+		return false, nil
+	}
+
+	f.ETag = objInfo.ETag
+	f.Size = uint64(objInfo.Size)
+	if objInfo.LastModified.After(f.Mtime) {
+		f.Mtime = objInfo.LastModified
+	}
+	if objInfo.LastModified.After(f.Chgtime) {
+		f.Chgtime = objInfo.LastModified
+	}
+	return true, nil
+}
+
+// cacheLoad copies the object from the block cache, this only succeeds when
+// all blocks of the object are cached.
+func (f *File) cacheLoad(w io.Writer, key string) bool {
+	cache := f.mfs.cache
+
+	blocks := (int64(f.Size) + blockSize - 1) / blockSize
+	for idx := int64(0); idx < blocks; idx++ {
+		if !cache.Contains(key, idx) {
+			return false
+		}
+	}
+
+	for idx := int64(0); idx < blocks; idx++ {
+		data, ok := cache.Get(key, idx)
+		if !ok {
+			return false
+		}
+		if _, err := w.Write(data); err != nil {
+			return false
+		}
+	}
+
+	return true
+}
+
 // Saves a new file at cached path and fetches the object based on
-// the incoming fuse request.
+// the incoming fuse request. The cached blocks are reused when the object
+// is unchanged, the download itself isn't added to the block cache so it
+// doesn't evict the blocks being read.
 func (f *File) cacheSave(ctx context.Context, path string, req *fuse.OpenRequest) error {
 	file, err := os.Create(path)
 	if err != nil {
@@ -154,20 +230,93 @@ func (f *File) cacheSave(ctx context.Context, path string, req *fuse.OpenRequest
 		return nil
 	}
 
-	object, err := f.mfs.api.GetObject(ctx, f.mfs.config.bucket, f.RemotePath(), minio.GetObjectOptions{})
-	if err != nil {
-		if meta.IsNoSuchObject(err) {
-			return fuse.ENOENT
-		}
-		return err
-	}
-	defer object.Close()
+	key := cacheKey(f.RemotePath(), f.ETag)
 
 	hasher := sha256.New()
-	size, err := io.Copy(file, io.TeeReader(object, hasher))
-	if err != nil {
+	if f.ETag != "" && f.cacheLoad(io.MultiWriter(file, hasher), key) {
+		// hash will be used when encrypting files
+		_ = hasher.Sum(nil)
+		return nil
+	}
+
+	// the cached copy is incomplete, start over
+	if err = file.Truncate(0); err != nil {
+		return err
+	}
+	if _, err = file.Seek(0, io.SeekStart); err != nil {
 		return err
 	}
+	hasher.Reset()
+
+	if f.parallelDownload() {
+		size, err := f.downloadParts(ctx, file)
+		if err != nil {
+			return err
+		}
+
+		f.Size = uint64(size)
+
+		// hash will be used when encrypting files, computed over the
+		// assembled file.
+		if _, err = io.Copy(hasher, io.NewSectionReader(file, 0, size)); err != nil {
+			return err
+		}
+		_ = hasher.Sum(nil)
+		return nil
+	}
+
+	opts := minio.GetObjectOptions{}
+	if f.ETag != "" {
+		// fetch exactly the version that has been validated
+		if err = opts.SetMatchETag(f.ETag); err != nil {
+			return err
+		}
+	}
+
+	var size int64
+	if err = f.mfs.retry(ctx, func() error {
+		// failed attempts start over
+		if size > 0 {
+			if err := file.Truncate(0); err != nil {
+				return err
+			}
+			if _, err := file.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+			hasher.Reset()
+			size = 0
+		}
+
+		object, err := f.mfs.api.GetObject(ctx, f.mfs.config.bucket, f.RemotePath(), opts)
+		if err != nil {
+			return err
+		}
+		defer object.Close()
+
+		w := io.MultiWriter(file, hasher)
+
+		buf := make([]byte, blockSize)
+		for {
+			n, rerr := io.ReadFull(object, buf)
+			if n > 0 {
+				if _, err = w.Write(buf[:n]); err != nil {
+					return err
+				}
+				size += int64(n)
+			}
+
+			if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+				return nil
+			} else if rerr != nil {
+				return rerr
+			}
+		}
+	}); err != nil {
+		if meta.IsNoSuchObject(err) {
+			return fuse.ENOENT
+		}
+		return ctxErrno(ctx, err)
+	}
 
 	// update actual file size
 	f.Size = uint64(size)
@@ -179,12 +328,89 @@ func (f *File) cacheSave(ctx context.Context, path string, req *fuse.OpenRequest
 	return nil
 }
 
+// Saves a new file at cached path from the staged copy of a pending upload.
+func (f *File) cacheStaged(path string, staged string) error {
+	r, err := os.Open(staged)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	fi, err := r.Stat()
+	if err != nil {
+		return err
+	}
+
+	if err = copyFile(path, r, fi.Size()); err != nil {
+		return err
+	}
+
+	f.Size = uint64(fi.Size())
+	return nil
+}
+
 // Open return a file handle of the opened file
-func (f *File) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
+func (f *File) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (h fs.Handle, err error) {
 	if err := f.dir.mfs.wait(f.Path); err != nil {
 		return nil, err
 	}
 
+	// uploads pending in write-back mode are newer than the remote object
+	staged, pending := f.mfs.pendingSource(f.RemotePath())
+	truncate := req.Flags&fuse.OpenTruncate == fuse.OpenTruncate
+
+	// reuse the cached blocks only if the remote object is unchanged
+	if !pending && !truncate {
+		changed, err := f.revalidate(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		if changed {
+			if err = f.mfs.db.Update(func(tx *meta.Tx) error {
+				return f.store(tx)
+			}); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// read-only opens don't download the object, the blocks being read
+	// are fetched with ranged requests through the block cache instead.
+	if !pending && req.Flags.IsReadOnly() {
+		fh, err := f.mfs.Acquire(f)
+		if err != nil {
+			return nil, err
+		}
+
+		fh.cacheKey = cacheKey(f.RemotePath(), f.ETag)
+
+		resp.Handle = fuse.HandleID(fh.handle)
+		return fh, nil
+	}
+
+	// writers hold the lease of the file, it is taken before the
+	// transaction as it takes requests to the bucket.
+	var leased bool
+	if !req.Flags.IsReadOnly() {
+		if err = f.mfs.acquireLease(f.FullPath()); err != nil {
+			return nil, err
+		}
+		leased = true
+	}
+
+	var fh *FileHandle
+	defer func() {
+		if err == nil {
+			return
+		}
+		if fh != nil {
+			f.mfs.Release(fh)
+		} else if leased {
+			f.mfs.releaseLease(f.FullPath())
+		}
+	}()
+
 	// Start a writable transaction.
 	tx, err := f.mfs.db.Begin(true)
 	if err != nil {
@@ -198,22 +424,41 @@ func (f *File) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenR
 		return nil, err
 	}
 
-	err = f.cacheSave(ctx, cachePath, req)
+	if pending && !truncate {
+		err = f.cacheStaged(cachePath, staged)
+	} else {
+		err = f.cacheSave(ctx, cachePath, req)
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	fh, err := f.mfs.Acquire(f)
-	if err != nil {
+	if fh, err = f.mfs.Acquire(f); err != nil {
 		return nil, err
 	}
 
+	fh.leased = leased
 	fh.cachePath = cachePath
 
-	fh.File, err = os.OpenFile(fh.cachePath, int(req.Flags), f.mfs.config.mode)
+	// the staged copy is newer than the remote object
+	if pending {
+		fh.base = 0
+	}
+
+	// appends are positioned by the handle
+	fh.append = req.Flags&fuse.OpenAppend == fuse.OpenAppend
+	fh.File, err = os.OpenFile(fh.cachePath, int(req.Flags&^fuse.OpenAppend), f.mfs.config.mode)
 	if err != nil {
 		return nil, err
 	}
+	fh.writable = !req.Flags.IsReadOnly()
+
+	// truncated files are rewritten from scratch and can be streamed, the
+	// truncation is uploaded even without writes.
+	if truncate {
+		fh.dirty = true
+		fh.sequential = f.mfs.config.streamUpload
+	}
 
 	if err = f.store(tx); err != nil {
 		return nil, err
@@ -245,6 +490,7 @@ func (f *File) Getattr(ctx context.Context, req *fuse.GetattrRequest, resp *fuse
 		Uid:    f.UID,
 		Gid:    f.GID,
 		Flags:  f.Flags,
+		Valid:  f.mfs.config.dirTTL,
 	}
 
 	return nil
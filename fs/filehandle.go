@@ -19,6 +19,8 @@ import (
 	"context"
 	"io"
 	"os"
+	"sync"
+	"syscall"
 
 	"bazil.org/fuse"
 
@@ -36,13 +38,65 @@ type FileHandle struct {
 	// cache file has been written to
 	dirty bool
 
+	// opened for writing, and with O_APPEND writes go to the end of the
+	// file
+	writable bool
+	append   bool
+
+	// the handle holds a reference of the lease of the file
+	leased bool
+
+	// ETag of the object when opened, uploads are conditional on it
+	etag string
+
+	// the first base bytes of the cache file outside of the written
+	// ranges are unchanged from the object with ETag etag.
+	base   int64
+	ranges []byteRange
+
 	cachePath string
 
+	// key of the object in the block cache, lazily opened files have no
+	// cache file and are read through the block cache instead.
+	cacheKey string
+
+	// read pattern and prefetches of reads through the block cache
+	ra readahead
+
+	// writes so far started at offset zero and were contiguous, the
+	// written data can be streamed to the bucket.
+	sequential bool
+	written    int64
+
+	// multipart upload of sequentially written data
+	stream    *streamUpload
+	streamErr error
+
+	m sync.Mutex
+
 	handle uint64
 }
 
 // Read from the file handle
 func (fh *FileHandle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	if fh.File == nil {
+		data, err := fh.readBlocks(ctx, req.Offset, int64(req.Size))
+		if err != nil {
+			return err
+		}
+		fh.readahead(req.Offset, int64(len(data)))
+		resp.Data = data
+		return nil
+	}
+
+	fh.m.Lock()
+	streamed := fh.streamed(req.Offset)
+	fh.m.Unlock()
+
+	if streamed {
+		return fuse.Errno(syscall.ESPIPE)
+	}
+
 	buff := make([]byte, req.Size)
 	n, err := fh.File.ReadAt(buff, req.Offset)
 	if err != nil && err != io.EOF {
@@ -54,7 +108,26 @@ func (fh *FileHandle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fus
 
 // Write to the file handle
 func (fh *FileHandle) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
-	if _, err := fh.File.Seek(req.Offset, 0); err != nil {
+	fh.m.Lock()
+	defer fh.m.Unlock()
+
+	if fh.streamErr != nil {
+		return fh.streamErr
+	}
+
+	// appends are written at the end of the file at the time of the write,
+	// not where the kernel thinks it is.
+	offset := req.Offset
+	if fh.append {
+		offset = int64(fh.f.Size)
+	}
+
+	// data that has been streamed already can't be rewritten
+	if fh.streamed(offset) {
+		return fuse.Errno(syscall.ESPIPE)
+	}
+
+	if _, err := fh.File.Seek(offset, 0); err != nil {
 		return err
 	}
 	n, err := fh.File.Write(req.Data)
@@ -64,11 +137,24 @@ func (fh *FileHandle) Write(ctx context.Context, req *fuse.WriteRequest, resp *f
 	// Writes that grow the file are expected to update the file size
 	// (as seen through Attr). Note that file size changes are
 	// communicated also through Setattr.
-	if fh.f.Size < uint64(req.Offset)+uint64(n) {
-		fh.f.Size = uint64(req.Offset) + uint64(n)
+	if fh.f.Size < uint64(offset)+uint64(n) {
+		fh.f.Size = uint64(offset) + uint64(n)
 	}
 	resp.Size = n
 	fh.dirty = true
+	fh.ranges = addRange(fh.ranges, offset, offset+int64(n))
+
+	if fh.sequential {
+		if offset != fh.written {
+			// random access, the remainder is uploaded at flush
+			fh.sequential = false
+		} else {
+			fh.written += int64(n)
+			if err := fh.streamParts(ctx); err != nil {
+				return fh.abortStream(err)
+			}
+		}
+	}
 	return nil
 }
 
@@ -80,12 +166,29 @@ func (f *File) Fsync(ctx context.Context, req *fuse.FsyncRequest) error {
 
 // Release the file handle
 func (fh *FileHandle) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
+	defer fh.f.mfs.Release(fh)
+
+	fh.stopReadahead()
+
+	// flock locks are released with the last close
+	if req.ReleaseFlags&fuse.ReleaseFlockUnlock != 0 {
+		fh.f.mfs.fileLocks.unlockAll(fh.f.Inode, req.LockOwner, true)
+	}
+
+	if fh.File == nil {
+		return nil
+	}
+
+	fh.m.Lock()
+	if fh.stream != nil && !fh.stream.done {
+		fh.abortStream(fuse.EINTR)
+	}
+	fh.m.Unlock()
+
 	if err := fh.Close(); err != nil {
 		return err
 	}
 
-	defer fh.f.mfs.Release(fh)
-
 	os.Remove(fh.cachePath)
 	return nil
 }
@@ -93,19 +196,55 @@ func (fh *FileHandle) Release(ctx context.Context, req *fuse.ReleaseRequest) err
 // Flush - experimenting with uploading at flush, this slows operations down till it has been
 // completely flushed
 func (fh *FileHandle) Flush(ctx context.Context, req *fuse.FlushRequest) error {
+	// POSIX locks are released with any close of the file
+	fh.f.mfs.fileLocks.unlockAll(fh.f.Inode, req.LockOwner, false)
+
+	fh.m.Lock()
+	defer fh.m.Unlock()
+
+	if fh.streamErr != nil {
+		return fh.streamErr
+	}
+
 	if !fh.dirty {
 		return nil
 	}
 
-	sr := newPutOp(fh.Name(), fh.f.RemotePath(), int64(fh.f.Size))
-	if err := fh.f.mfs.sync(&sr); err != nil {
-		return err
-	}
+	if fh.stream != nil {
+		if err := fh.completeStream(ctx); err != nil {
+			return fh.abortStream(err)
+		}
+	} else if fh.f.mfs.config.writeback {
+		// the upload continues in the background once the data is
+		// safely staged in the cache.
+		if err := fh.f.mfs.stage(fh); err != nil {
+			return err
+		}
 
-	// we'll wait for the request to be uploaded and synced, before
-	// releasing the file
-	if err := <-sr.Error; err != nil {
-		return err
+		fh.dirty = false
+		return nil
+	} else {
+		sr := newPutOp(ctx, fh.Name(), fh.f.RemotePath(), int64(fh.f.Size), fh.f.userMetadata(), fh.f.Tags)
+		sr.Conditional, sr.Match = true, fh.etag
+		sr.Base, sr.Dirty = fh.base, fh.ranges
+		if err := fh.f.mfs.sync(&sr); err != nil {
+			return err
+		}
+
+		// we'll wait for the request to be uploaded and synced, before
+		// releasing the file
+		if err := sr.wait(); err != nil {
+			return err
+		}
+
+		fh.f.ETag = sr.ETag
+		if sr.Conflict != "" {
+			// the version of the other writer is fetched on next open
+			fh.f.ETag = ""
+		}
+		fh.etag = fh.f.ETag
+		fh.base, fh.ranges = int64(fh.f.Size), nil
+		fh.f.Metadata, fh.f.Tags = nil, nil
 	}
 
 	// update cache
@@ -0,0 +1,261 @@
+// Copyright (c) 2021 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package minfs
+
+import (
+	"context"
+	"sync"
+	"syscall"
+
+	"bazil.org/fuse"
+)
+
+// rangeLock is an advisory byte range lock, the range is inclusive. flock
+// locks are whole file locks covering the maximum range, they are
+// independent of POSIX locks like on Linux.
+type rangeLock struct {
+	owner fuse.LockOwner
+	pid   int32
+	typ   fuse.LockType
+	flock bool
+
+	start uint64
+	end   uint64
+}
+
+func (l rangeLock) overlaps(start, end uint64) bool {
+	return l.start <= end && start <= l.end
+}
+
+// conflicts returns if l prevents taking the lock r of the same kind.
+func (l rangeLock) conflicts(r rangeLock) bool {
+	if l.flock != r.flock || l.owner == r.owner || !l.overlaps(r.start, r.end) {
+		return false
+	}
+	return l.typ == fuse.LockWrite || r.typ == fuse.LockWrite
+}
+
+// fileLocks holds the advisory locks of a file, changed is closed and
+// replaced whenever locks are released to wake up waiters.
+type fileLocks struct {
+	locks   []rangeLock
+	changed chan struct{}
+}
+
+// lockTable contains the advisory locks of all files of the mount by inode.
+type lockTable struct {
+	m     sync.Mutex
+	files map[uint64]*fileLocks
+}
+
+func newLockTable() *lockTable {
+	return &lockTable{
+		files: map[uint64]*fileLocks{},
+	}
+}
+
+func (lt *lockTable) get(inode uint64) *fileLocks {
+	fl, ok := lt.files[inode]
+	if !ok {
+		fl = &fileLocks{changed: make(chan struct{})}
+		lt.files[inode] = fl
+	}
+	return fl
+}
+
+// tryLock acquires the lock if there are no conflicting locks, otherwise it
+// returns a channel which is closed when locks are released.
+func (lt *lockTable) tryLock(inode uint64, l rangeLock) (bool, <-chan struct{}) {
+	lt.m.Lock()
+	defer lt.m.Unlock()
+
+	fl := lt.get(inode)
+	for _, other := range fl.locks {
+		if other.conflicts(l) {
+			return false, fl.changed
+		}
+	}
+
+	// a new lock of the owner replaces its locks in the range
+	fl.locks = removeRange(fl.locks, l)
+	fl.locks = append(fl.locks, l)
+
+	// downgrades allow others in
+	lt.notify(fl)
+	return true, nil
+}
+
+// unlock releases the locks of the owner and kind of l in its range.
+func (lt *lockTable) unlock(inode uint64, l rangeLock) {
+	lt.m.Lock()
+	defer lt.m.Unlock()
+
+	fl, ok := lt.files[inode]
+	if !ok {
+		return
+	}
+
+	fl.locks = removeRange(fl.locks, l)
+	lt.release(inode, fl)
+}
+
+// unlockAll releases all locks of owner, either the flock or the POSIX ones.
+func (lt *lockTable) unlockAll(inode uint64, owner fuse.LockOwner, flock bool) {
+	lt.m.Lock()
+	defer lt.m.Unlock()
+
+	fl, ok := lt.files[inode]
+	if !ok {
+		return
+	}
+
+	locks := fl.locks[:0]
+	for _, l := range fl.locks {
+		if l.owner != owner || l.flock != flock {
+			locks = append(locks, l)
+		}
+	}
+	fl.locks = locks
+
+	lt.release(inode, fl)
+}
+
+// query returns a lock conflicting with the requested one.
+func (lt *lockTable) query(inode uint64, r rangeLock) (rangeLock, bool) {
+	lt.m.Lock()
+	defer lt.m.Unlock()
+
+	fl, ok := lt.files[inode]
+	if !ok {
+		return rangeLock{}, false
+	}
+
+	for _, l := range fl.locks {
+		if l.conflicts(r) {
+			return l, true
+		}
+	}
+	return rangeLock{}, false
+}
+
+func (lt *lockTable) release(inode uint64, fl *fileLocks) {
+	lt.notify(fl)
+
+	if len(fl.locks) == 0 {
+		delete(lt.files, inode)
+	}
+}
+
+func (lt *lockTable) notify(fl *fileLocks) {
+	close(fl.changed)
+	fl.changed = make(chan struct{})
+}
+
+// removeRange removes the range of r from the locks of its owner and kind,
+// locks partially inside the range are split.
+func removeRange(locks []rangeLock, r rangeLock) []rangeLock {
+	start, end := r.start, r.end
+
+	var result []rangeLock
+	for _, l := range locks {
+		if l.owner != r.owner || l.flock != r.flock || !l.overlaps(start, end) {
+			result = append(result, l)
+			continue
+		}
+
+		if l.start < start {
+			head := l
+			head.end = start - 1
+			result = append(result, head)
+		}
+
+		if l.end > end {
+			tail := l
+			tail.start = end + 1
+			result = append(result, tail)
+		}
+	}
+	return result
+}
+
+func newRangeLock(req *fuse.LockRequest) rangeLock {
+	return rangeLock{
+		owner: req.LockOwner,
+		pid:   req.Lock.PID,
+		typ:   req.Lock.Type,
+		flock: req.LockFlags&fuse.LockFlock != 0,
+		start: req.Lock.Start,
+		end:   req.Lock.End,
+	}
+}
+
+// Lock acquires an advisory lock, EAGAIN is returned when a conflicting lock
+// is held.
+func (fh *FileHandle) Lock(ctx context.Context, req *fuse.LockRequest) error {
+	if ok, _ := fh.f.mfs.fileLocks.tryLock(fh.f.Inode, newRangeLock(req)); !ok {
+		return fuse.Errno(syscall.EAGAIN)
+	}
+	return nil
+}
+
+// LockWait acquires an advisory lock, waiting for conflicting locks to be
+// released.
+func (fh *FileHandle) LockWait(ctx context.Context, req *fuse.LockWaitRequest) error {
+	lr := fuse.LockRequest(*req)
+
+	l := newRangeLock(&lr)
+	for {
+		ok, changed := fh.f.mfs.fileLocks.tryLock(fh.f.Inode, l)
+		if ok {
+			return nil
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return fuse.EINTR
+		}
+	}
+}
+
+// Unlock releases an advisory lock.
+func (fh *FileHandle) Unlock(ctx context.Context, req *fuse.UnlockRequest) error {
+	lr := fuse.LockRequest(*req)
+	fh.f.mfs.fileLocks.unlock(fh.f.Inode, newRangeLock(&lr))
+	return nil
+}
+
+// QueryLock returns a lock conflicting with the requested one.
+func (fh *FileHandle) QueryLock(ctx context.Context, req *fuse.QueryLockRequest, resp *fuse.QueryLockResponse) error {
+	l, ok := fh.f.mfs.fileLocks.query(fh.f.Inode, rangeLock{
+		owner: req.LockOwner,
+		typ:   req.Lock.Type,
+		flock: req.LockFlags&fuse.LockFlock != 0,
+		start: req.Lock.Start,
+		end:   req.Lock.End,
+	})
+	if !ok {
+		return nil
+	}
+
+	resp.Lock = fuse.FileLock{
+		Start: l.start,
+		End:   l.end,
+		Type:  l.typ,
+		PID:   l.pid,
+	}
+	return nil
+}
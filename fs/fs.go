@@ -21,12 +21,10 @@ import (
 	"crypto/tls"
 	"fmt"
 	"log"
-	"mime"
 	"net"
 	"net/http"
 	"os"
 	"path"
-	"path/filepath"
 	"sync"
 	"syscall"
 	"time"
@@ -42,6 +40,10 @@ import (
 var (
 	_ = meta.RegisterExt(1, File{})
 	_ = meta.RegisterExt(2, Dir{})
+	_ = meta.RegisterExt(3, PendingUpload{})
+	_ = meta.RegisterExt(4, Symlink{})
+	_ = meta.RegisterExt(5, RenameJournal{})
+	_ = meta.RegisterExt(6, RenameObject{})
 )
 
 // MinFS contains the meta data for the MinFS client
@@ -51,19 +53,50 @@ type MinFS struct {
 
 	db *meta.DB
 
+	// persistent cache of object blocks
+	cache *blockCache
+
 	// Logger instance.
 	log *log.Logger
 
 	// contains all open handles
-	handles []*FileHandle
+	handles *handleTable
+
+	// number of open handles by path
+	locks map[string]int
+
+	// advisory locks taken with flock and fcntl
+	fileLocks *lockTable
 
-	locks map[string]bool
+	// leases held in distributed locking mode, and the owner id of this
+	// mount. leasePaths serializes taking and releasing the lease of a
+	// path.
+	leases     map[string]*lease
+	leasePaths map[string]*pathMutex
+	owner      string
 
 	m sync.Mutex
 
-	syncChan chan interface{}
+	// sync operations waiting for a worker
+	syncQueue *syncQueue
+
+	// staged uploads in write-back mode, and the targets being uploaded
+	// closed when done
+	writebackCh   chan string
+	writebackM    sync.Mutex
+	writebackBusy map[string]chan struct{}
 
 	listenerDoneCh chan struct{}
+	shutdownOnce   sync.Once
+
+	// closed on shutdown, stops the background retries
+	doneCh chan struct{}
+
+	server *fs.Server
+
+	// directories known to the kernel by inode, used to invalidate
+	// their entries
+	nodes map[uint64]*Dir
 }
 
 // New will return a new MinFS client
@@ -83,6 +116,8 @@ func New(options ...func(*Config)) (*MinFS, error) {
 	// Set defaults
 	cfg := &Config{
 		cache:     globalDBDir,
+		cacheSize: globalCacheSize,
+		readahead: globalReadahead,
 		basePath:  "",
 		accountID: fmt.Sprintf("%d", time.Now().UTC().Unix()),
 		gid:       0,
@@ -90,6 +125,11 @@ func New(options ...func(*Config)) (*MinFS, error) {
 		accessKey: ac.AccessKey,
 		secretKey: ac.SecretKey,
 		mode:      os.FileMode(0660),
+
+		uploadWorkers:   globalUploadWorkers,
+		downloadWorkers: globalDownloadWorkers,
+		retryAttempts:   globalRetryAttempts,
+		retryBackoff:    globalRetryBackoff,
 	}
 
 	for _, optionFn := range options {
@@ -103,10 +143,19 @@ func New(options ...func(*Config)) (*MinFS, error) {
 	// Initialize MinFS.
 	fs := &MinFS{
 		config:         cfg,
-		syncChan:       make(chan interface{}),
-		locks:          map[string]bool{},
+		syncQueue:      newSyncQueue(),
+		writebackCh:    make(chan string, 1024),
+		writebackBusy:  map[string]chan struct{}{},
+		locks:          map[string]int{},
+		handles:        newHandleTable(cfg.maxOpenFiles),
+		fileLocks:      newLockTable(),
+		leases:         map[string]*lease{},
+		leasePaths:     map[string]*pathMutex{},
+		owner:          leaseOwner(),
 		log:            log.New(logW, "MinFS ", log.Ldate|log.Ltime|log.Lshortfile),
 		listenerDoneCh: make(chan struct{}),
+		doneCh:         make(chan struct{}),
+		nodes:          map[uint64]*Dir{},
 	}
 
 	// Success..
@@ -122,6 +171,8 @@ func (mfs *MinFS) mount() (*fuse.Conn, error) {
 		fuse.VolumeName(mfs.config.bucket),
 		fuse.AllowOther(),
 		fuse.DefaultPermissions(),
+		fuse.LockingFlock(),
+		fuse.LockingPOSIX(),
 	)
 }
 
@@ -164,12 +215,24 @@ func (mfs *MinFS) Serve() (err error) {
 
 	mfs.log.Println("Initializing cache database...")
 	if err = mfs.db.Update(func(tx *meta.Tx) error {
-		_, berr := tx.CreateBucketIfNotExists([]byte("minio/"))
+		if _, berr := tx.CreateBucketIfNotExists([]byte("minio/")); berr != nil {
+			return berr
+		}
+		if _, berr := tx.CreateBucketIfNotExists([]byte("writeback/")); berr != nil {
+			return berr
+		}
+		_, berr := tx.CreateBucketIfNotExists([]byte("renames/"))
 		return berr
 	}); err != nil {
 		return err
 	}
 
+	mfs.log.Println("Opening block cache...")
+	mfs.cache, err = newBlockCache(path.Join(mfs.config.cache, "blocks"), mfs.config.cacheSize)
+	if err != nil {
+		return err
+	}
+
 	mfs.log.Println("Initializing minio client...")
 
 	var (
@@ -202,6 +265,9 @@ func (mfs *MinFS) Serve() (err error) {
 		DisableCompression: true,
 	}
 
+	// requests are retried by retry, as configured
+	minio.MaxRetry = 1
+
 	creds := credentials.NewStaticV4(access, secret, token)
 	options := &minio.Options{
 		Creds:     creds,
@@ -215,8 +281,11 @@ func (mfs *MinFS) Serve() (err error) {
 	}
 
 	// Validate if the bucket is valid and accessible.
-	exists, err := mfs.api.BucketExists(context.Background(), mfs.config.bucket)
-	if err != nil {
+	var exists bool
+	if err = mfs.retry(context.Background(), func() (err error) {
+		exists, err = mfs.api.BucketExists(context.Background(), mfs.config.bucket)
+		return err
+	}); err != nil {
 		return err
 	}
 	if !exists {
@@ -228,9 +297,23 @@ func (mfs *MinFS) Serve() (err error) {
 		return err
 	}
 
+	// uploads pending from a previous run are replayed even when
+	// write-back mode has been disabled since.
+	if err = mfs.startWriteback(); err != nil {
+		return err
+	}
+
+	// directory renames interrupted by a previous run are rolled forward
+	if err = mfs.resumeRenames(); err != nil {
+		return err
+	}
+
+	mfs.startListener()
+
 	mfs.log.Println("Serving... Have fun!")
 	// Serve the filesystem
-	if err = fs.Serve(c, mfs); err != nil {
+	mfs.server = fs.New(c, nil)
+	if err = mfs.server.Serve(mfs); err != nil {
 		mfs.log.Println("Error while serving the file system.", err)
 		return err
 	}
@@ -240,79 +323,155 @@ func (mfs *MinFS) Serve() (err error) {
 }
 
 func (mfs *MinFS) shutdown() {
+	mfs.shutdownOnce.Do(func() {
+		close(mfs.listenerDoneCh)
+		close(mfs.doneCh)
+	})
+
 	fuse.Unmount(mfs.config.mountpoint)
 	mfs.log.Println("MinFS stopped cleanly.")
 }
 
 func (mfs *MinFS) sync(req interface{}) error {
-	mfs.syncChan <- req
+	mfs.syncQueue.push(req)
 	return nil
 }
 
-func (mfs *MinFS) moveOp(req *MoveOperation) {
-	dst := minio.CopyDestOptions{
-		Bucket: mfs.config.bucket,
-		Object: req.Target,
-	}
-	src := minio.CopySrcOptions{
-		Bucket: mfs.config.bucket,
-		Object: req.Source,
-	}
-	if _, err := mfs.api.CopyObject(context.Background(), dst, src); err != nil {
-		req.Error <- err
-		return
-	}
-	req.Error <- mfs.api.RemoveObject(context.Background(), mfs.config.bucket, req.Source, minio.RemoveObjectOptions{})
+func (mfs *MinFS) moveOp(ctx context.Context, req *MoveOperation) error {
+	return mfs.moveObject(ctx, req.Source, req.Target)
 }
 
-func (mfs *MinFS) copyOp(req *CopyOperation) {
-	dst := minio.CopyDestOptions{
-		Bucket: mfs.config.bucket,
-		Object: req.Target,
-	}
-	src := minio.CopySrcOptions{
-		Bucket: mfs.config.bucket,
-		Object: req.Source,
-	}
-	_, err := mfs.api.CopyObject(context.Background(), dst, src)
-	req.Error <- err
+func (mfs *MinFS) copyOp(ctx context.Context, req *CopyOperation) (err error) {
+	req.ETag, err = mfs.copyObject(ctx, req.Source, req.Target, req.Metadata)
+	return err
+}
+
+// maxCopySize is the largest object copied with a single request.
+const maxCopySize = 5 << 30
+
+// copyObject copies source to target, metadata replaces the user metadata of
+// the source if set. Larger objects are copied in parts, which doesn't carry
+// over the tags, these are set explicitly then.
+func (mfs *MinFS) copyObject(ctx context.Context, source, target string, metadata map[string]string) (etag string, err error) {
+	err = mfs.retry(ctx, func() error {
+		dst := minio.CopyDestOptions{
+			Bucket:          mfs.config.bucket,
+			Object:          target,
+			UserMetadata:    metadata,
+			ReplaceMetadata: metadata != nil,
+		}
+		src := minio.CopySrcOptions{
+			Bucket: mfs.config.bucket,
+			Object: source,
+		}
+
+		objInfo, err := mfs.api.StatObject(ctx, mfs.config.bucket, source, minio.StatObjectOptions{})
+		if err != nil {
+			return err
+		}
+
+		var info minio.UploadInfo
+		if objInfo.Size <= maxCopySize {
+			info, err = mfs.api.CopyObject(ctx, dst, src)
+		} else {
+			if objInfo.UserTagCount > 0 {
+				t, err := mfs.api.GetObjectTagging(ctx, mfs.config.bucket, source, minio.GetObjectTaggingOptions{})
+				if err != nil {
+					return err
+				}
+				dst.UserTags, dst.ReplaceTags = t.ToMap(), true
+			}
+			info, err = mfs.api.ComposeObject(ctx, dst, src)
+		}
+		etag = info.ETag
+		return err
+	})
+	return etag, err
 }
 
-func (mfs *MinFS) putOp(req *PutOperation) {
-	r, err := os.Open(req.Source)
+func (mfs *MinFS) putOp(ctx context.Context, req *PutOperation) error {
+	current, err := mfs.currentObject(ctx, req.Target)
 	if err != nil {
-		req.Error <- err
-		return
+		return err
+	}
+
+	// our version is kept next to the one of the other writer
+	if req.Conditional && conflicting(current, req.Match) {
+		req.Conflict = conflictName(req.Target)
+		mfs.log.Printf("Object %s has been changed by someone else, uploading to %s.\n", req.Target, req.Conflict)
 	}
-	defer r.Close()
 
-	ops := minio.PutObjectOptions{
-		ContentType: mime.TypeByExtension(filepath.Ext(req.Target)),
+	target := req.Target
+	if req.Conflict != "" {
+		target, current = req.Conflict, nil
 	}
-	_, err = mfs.api.PutObject(context.Background(), mfs.config.bucket, req.Target, r, req.Length, ops)
+
+	ops, err := mfs.uploadOptions(ctx, target, current, req.Metadata, req.Tags)
 	if err != nil {
-		req.Error <- err
-		return
+		return err
+	}
+
+	if req.partialUpload() {
+		err = mfs.partUpload(ctx, req, ops)
+		if err == nil {
+			return nil
+		} else if _, ok := err.(copySourceError); !ok {
+			return err
+		}
+
+		// the object can't be copied from anymore, upload it in full
+		mfs.log.Printf("Partial upload of %s failed, uploading in full: %s.\n", target, err)
+	}
+
+	if err = mfs.retry(ctx, func() error {
+		r, err := os.Open(req.Source)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+
+		info, err := mfs.api.PutObject(ctx, mfs.config.bucket, target, r, req.Length, ops)
+		req.ETag = info.ETag
+		return err
+	}); err != nil {
+		return err
 	}
-	mfs.log.Printf("Upload finished: %s -> %s.\n", req.Source, req.Target)
-	req.Error <- nil
+
+	mfs.log.Printf("Upload finished: %s -> %s.\n", req.Source, target)
+	return nil
 }
 
+// runOp runs the operation and reports its result, operations of
+// interrupted requests are aborted with EINTR.
+func (mfs *MinFS) runOp(req interface{}) {
+	switch req := req.(type) {
+	case *MoveOperation:
+		ctx, cancel := req.context(mfs.config.opTimeout)
+		defer cancel()
+		req.Error <- req.result(ctx, mfs.moveOp(ctx, req))
+	case *CopyOperation:
+		ctx, cancel := req.context(mfs.config.opTimeout)
+		defer cancel()
+		req.Error <- req.result(ctx, mfs.copyOp(ctx, req))
+	case *PutOperation:
+		ctx, cancel := req.context(mfs.config.opTimeout)
+		defer cancel()
+		req.Error <- req.result(ctx, mfs.putOp(ctx, req))
+	}
+}
+
+// startSync starts the sync workers, operations on the same object are run
+// in order.
 func (mfs *MinFS) startSync() error {
-	go func() {
-		for req := range mfs.syncChan {
-			switch req := req.(type) {
-			case *MoveOperation:
-				mfs.moveOp(req)
-			case *CopyOperation:
-				mfs.copyOp(req)
-			case *PutOperation:
-				mfs.putOp(req)
-			default:
-				panic("Unknown type")
+	for i := 0; i < mfs.config.uploadWorkers; i++ {
+		go func() {
+			for {
+				req := mfs.syncQueue.next()
+				mfs.runOp(req)
+				mfs.syncQueue.done(req)
 			}
-		}
-	}()
+		}()
+	}
 	return nil
 }
 
@@ -333,12 +492,15 @@ func (mfs *MinFS) Acquire(f *File) (*FileHandle, error) {
 	}
 
 	h := &FileHandle{
-		f: f,
+		f:    f,
+		etag: f.ETag,
+		base: int64(f.Size),
 	}
 
-	mfs.handles = append(mfs.handles, h)
-
-	h.handle = uint64(len(mfs.handles) - 1)
+	if err := mfs.handles.add(h); err != nil {
+		mfs.Unlock(f.FullPath())
+		return nil, err
+	}
 	return h, nil
 }
 
@@ -348,7 +510,11 @@ func (mfs *MinFS) Release(fh *FileHandle) error {
 		return err
 	}
 
-	mfs.handles[fh.handle] = nil
+	if fh.leased {
+		mfs.releaseLease(fh.f.FullPath())
+	}
+
+	mfs.handles.remove(fh)
 	return nil
 }
 
@@ -360,6 +526,12 @@ func (mfs *MinFS) NextSequence(tx *meta.Tx) (sequence uint64, err error) {
 
 // Root is the root folder of the MinFS mountpoint
 func (mfs *MinFS) Root() (fs.Node, error) {
+	root := mfs.rootDir()
+	mfs.registerDir(root)
+	return root, nil
+}
+
+func (mfs *MinFS) rootDir() *Dir {
 	return &Dir{
 		dir:  nil,
 		mfs:  mfs,
@@ -368,7 +540,15 @@ func (mfs *MinFS) Root() (fs.Node, error) {
 		UID:  mfs.config.uid,
 		GID:  mfs.config.gid,
 		Mode: os.ModeDir | 0750,
-	}, nil
+	}
+}
+
+// registerDir records a directory node handed to the kernel.
+func (mfs *MinFS) registerDir(dir *Dir) {
+	mfs.m.Lock()
+	defer mfs.m.Unlock()
+
+	mfs.nodes[dir.Inode] = dir
 }
 
 // Storer -
@@ -15,9 +15,27 @@
 
 package minfs
 
+import "time"
+
 // Package cmd contains all the global variables and constants.
 const (
 	globalConfigFile = "/etc/minfs/config.json"
 	globalDBDir      = "/etc/minfs/db"
 	globalLogFile    = "/var/log/minfs.log"
+
+	// default maximum size of the block cache.
+	globalCacheSize = 10 << 30
+
+	// default size of the readahead window of sequential reads.
+	globalReadahead = 8 << 20
+
+	// default number of concurrent ranged requests downloading a file.
+	globalDownloadWorkers = 4
+
+	// default number of concurrent sync operations.
+	globalUploadWorkers = 4
+
+	// default number of attempts and initial backoff of S3 calls.
+	globalRetryAttempts = 5
+	globalRetryBackoff  = 200 * time.Millisecond
 )
@@ -0,0 +1,135 @@
+// Copyright (c) 2021 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package minfs
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"syscall"
+
+	"bazil.org/fuse"
+)
+
+// handleTable contains the open handles by id, the ids of released handles
+// are reused.
+type handleTable struct {
+	m       sync.Mutex
+	handles []*FileHandle
+	free    []uint64
+
+	// maximum number of open handles, zero is unlimited
+	max   int
+	count int
+}
+
+func newHandleTable(max int) *handleTable {
+	return &handleTable{
+		max: max,
+	}
+}
+
+// add stores the handle and sets its id, ENFILE is returned when the
+// maximum number of handles is open.
+func (ht *handleTable) add(h *FileHandle) error {
+	ht.m.Lock()
+	defer ht.m.Unlock()
+
+	if ht.max > 0 && ht.count >= ht.max {
+		return fuse.Errno(syscall.ENFILE)
+	}
+
+	if n := len(ht.free); n > 0 {
+		h.handle = ht.free[n-1]
+		ht.free = ht.free[:n-1]
+		ht.handles[h.handle] = h
+	} else {
+		h.handle = uint64(len(ht.handles))
+		ht.handles = append(ht.handles, h)
+	}
+
+	ht.count++
+	return nil
+}
+
+// remove frees the id of the handle.
+func (ht *handleTable) remove(h *FileHandle) {
+	ht.m.Lock()
+	defer ht.m.Unlock()
+
+	if h.handle >= uint64(len(ht.handles)) || ht.handles[h.handle] != h {
+		return
+	}
+
+	ht.handles[h.handle] = nil
+	ht.free = append(ht.free, h.handle)
+	ht.count--
+}
+
+// list returns the open handles.
+func (ht *handleTable) list() []*FileHandle {
+	ht.m.Lock()
+	defer ht.m.Unlock()
+
+	handles := make([]*FileHandle, 0, ht.count)
+	for _, h := range ht.handles {
+		if h != nil {
+			handles = append(handles, h)
+		}
+	}
+	return handles
+}
+
+// xattrOpenFiles is the control attribute of the root directory listing the
+// open handles of the mount for diagnostics, one "<handle> <path>" per line,
+// e.g.
+//
+//	getfattr --only-values -n user.minfs.open_files /mnt/bucket
+const xattrOpenFiles = "user.minfs.open_files"
+
+// handleInfo describes an open file handle.
+type handleInfo struct {
+	handle uint64
+	path   string
+}
+
+// openHandles returns the handles currently open on the mount.
+func (mfs *MinFS) openHandles() []handleInfo {
+	var infos []handleInfo
+	for _, h := range mfs.handles.list() {
+		infos = append(infos, handleInfo{
+			handle: h.handle,
+			path:   h.f.FullPath(),
+		})
+	}
+	return infos
+}
+
+// Getxattr returns the control attributes of the root directory.
+func (dir *Dir) Getxattr(ctx context.Context, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
+	if dir.dir != nil || req.Name != xattrOpenFiles {
+		return fuse.ErrNoXattr
+	}
+
+	var b strings.Builder
+	for _, info := range dir.mfs.openHandles() {
+		fmt.Fprintf(&b, "%d %s\n", info.handle, info.path)
+	}
+
+	resp.Xattr = []byte(b.String())
+	return nil
+}
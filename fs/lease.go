@@ -0,0 +1,252 @@
+// Copyright (c) 2021 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package minfs
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	"github.com/minio/minfs/meta"
+	minio "github.com/minio/minio-go/v7"
+)
+
+// Leases are objects below leasePrefix in the bucket, named by the path of
+// the locked object and holding the owning mount and expiry in the user
+// metadata. They are renewed while held, so the leases of crashed mounts
+// expire after leaseTTL.
+const (
+	leasePrefix        = ".minfs/locks/"
+	leaseTTL           = 30 * time.Second
+	leaseRenewInterval = leaseTTL / 3
+
+	metaLeaseOwner   = "Lease-Owner"
+	metaLeaseExpires = "Lease-Expires"
+)
+
+// lease is a lock object held by this mount, shared by the handles of the
+// file opened for writing. It is lost when another mount took it over after
+// a renewal failed.
+type lease struct {
+	object string
+	cancel context.CancelFunc
+	refs   int
+	lost   bool
+}
+
+// pathMutex serializes the lease requests of a path, it is removed once no
+// request holds or waits for it.
+type pathMutex struct {
+	sync.Mutex
+	refs int
+}
+
+// lockLeasePath locks the lease requests of path p, the returned func
+// unlocks them.
+func (mfs *MinFS) lockLeasePath(p string) func() {
+	mfs.m.Lock()
+	pm, ok := mfs.leasePaths[p]
+	if !ok {
+		pm = &pathMutex{}
+		mfs.leasePaths[p] = pm
+	}
+	pm.refs++
+	mfs.m.Unlock()
+
+	pm.Lock()
+	return func() {
+		pm.Unlock()
+
+		mfs.m.Lock()
+		if pm.refs--; pm.refs == 0 {
+			delete(mfs.leasePaths, p)
+		}
+		mfs.m.Unlock()
+	}
+}
+
+// leaseOwner identifies this mount in the leases it holds.
+func leaseOwner() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	return fmt.Sprintf("%s-%d-%s", hostname, os.Getpid(), nextSuffix())
+}
+
+// internalObject returns if the object is used by MinFS itself and hidden
+// from the mount.
+func (mfs *MinFS) internalObject(key string) bool {
+	return mfs.config.basePath == "" && strings.HasPrefix(key, ".minfs/")
+}
+
+// acquireLease takes the lease of the object at path, or a reference of it
+// when it is held already, EBUSY is returned while another mount holds an
+// unexpired lease. The lease is checked after writing it.
+func (mfs *MinFS) acquireLease(p string) error {
+	if !mfs.config.distributedLocks {
+		return nil
+	}
+
+	defer mfs.lockLeasePath(p)()
+
+	// the file is open for writing already
+	mfs.m.Lock()
+	if l, ok := mfs.leases[p]; ok {
+		defer mfs.m.Unlock()
+		if l.lost {
+			return fuse.Errno(syscall.EBUSY)
+		}
+		l.refs++
+		return nil
+	}
+	mfs.m.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), leaseTTL)
+	defer cancel()
+
+	object := leasePrefix + path.Join(mfs.config.basePath, p)
+
+	if owner, expires, err := mfs.statLease(ctx, object); err != nil && !meta.IsNoSuchObject(err) {
+		return err
+	} else if err == nil && owner != mfs.owner && time.Now().Before(expires) {
+		return fuse.Errno(syscall.EBUSY)
+	}
+
+	if err := mfs.putLease(ctx, object); err != nil {
+		return err
+	}
+
+	if owner, _, err := mfs.statLease(ctx, object); err != nil {
+		return err
+	} else if owner != mfs.owner {
+		// lost the race against another mount
+		return fuse.Errno(syscall.EBUSY)
+	}
+
+	lctx, lcancel := context.WithCancel(context.Background())
+	l := &lease{object: object, cancel: lcancel, refs: 1}
+
+	mfs.m.Lock()
+	mfs.leases[p] = l
+	mfs.m.Unlock()
+
+	go mfs.renewLease(lctx, l)
+	return nil
+}
+
+// releaseLease drops a reference of the lease of the object at path, the
+// lease is removed with the last one, if it is still ours.
+func (mfs *MinFS) releaseLease(p string) {
+	defer mfs.lockLeasePath(p)()
+
+	mfs.m.Lock()
+	l, ok := mfs.leases[p]
+	if ok {
+		if l.refs--; l.refs > 0 {
+			ok = false
+		} else {
+			delete(mfs.leases, p)
+		}
+	}
+	mfs.m.Unlock()
+
+	if !ok {
+		return
+	}
+
+	l.cancel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), leaseTTL)
+	defer cancel()
+
+	if owner, _, err := mfs.statLease(ctx, l.object); err != nil || owner != mfs.owner {
+		return
+	}
+
+	if err := mfs.retry(ctx, func() error {
+		return mfs.api.RemoveObject(ctx, mfs.config.bucket, l.object, minio.RemoveObjectOptions{})
+	}); err != nil {
+		mfs.log.Println("Unable to release lease.", err)
+	}
+}
+
+// renewLease extends the lease till ctx is canceled, or till another mount
+// has taken it over after it expired. The lease is lost then.
+func (mfs *MinFS) renewLease(ctx context.Context, l *lease) {
+	ticker := time.NewTicker(leaseRenewInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		owner, _, err := mfs.statLease(ctx, l.object)
+		if err != nil && !meta.IsNoSuchObject(err) {
+			if ctx.Err() == nil {
+				mfs.log.Println("Unable to renew lease.", err)
+			}
+			continue
+		} else if err == nil && owner != mfs.owner {
+			mfs.log.Printf("Lease %s has been taken over by %s, writes to the file are no longer exclusive.\n", l.object, owner)
+
+			mfs.m.Lock()
+			l.lost = true
+			mfs.m.Unlock()
+			return
+		}
+
+		if err := mfs.putLease(ctx, l.object); err != nil && ctx.Err() == nil {
+			mfs.log.Println("Unable to renew lease.", err)
+		}
+	}
+}
+
+func (mfs *MinFS) putLease(ctx context.Context, object string) error {
+	expires := time.Now().Add(leaseTTL).Unix()
+	return mfs.retry(ctx, func() error {
+		_, err := mfs.api.PutObject(ctx, mfs.config.bucket, object, strings.NewReader(""), 0, minio.PutObjectOptions{
+			UserMetadata: map[string]string{
+				metaLeaseOwner:   mfs.owner,
+				metaLeaseExpires: strconv.FormatInt(expires, 10),
+			},
+		})
+		return err
+	})
+}
+
+func (mfs *MinFS) statLease(ctx context.Context, object string) (owner string, expires time.Time, err error) {
+	objInfo, err := mfs.statObject(ctx, object)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	md := normalizeMetadata(objInfo.UserMetadata)
+	if sec, err := strconv.ParseInt(md[metaLeaseExpires], 10, 64); err == nil {
+		expires = time.Unix(sec, 0)
+	}
+	return md[metaLeaseOwner], expires, nil
+}
@@ -21,22 +21,26 @@ import (
 	"bazil.org/fuse"
 )
 
-// Unlock - unlock the lock at path.
+// Unlock - releases a lock at path, the path is unlocked once all its locks
+// are released.
 func (mfs *MinFS) Unlock(path string) error {
 	mfs.m.Lock()
 	defer mfs.m.Unlock()
 
-	delete(mfs.locks, path)
+	if mfs.locks[path]--; mfs.locks[path] <= 0 {
+		delete(mfs.locks, path)
+	}
 
 	return nil
 }
 
-// Lock - acquires a lock at path.
+// Lock - acquires a lock at path, every open handle holds one.
 func (mfs *MinFS) Lock(path string) error {
 	mfs.m.Lock()
 	defer mfs.m.Unlock()
 
-	mfs.locks[path] = true
+	mfs.locks[path]++
+
 	return nil
 }
 
@@ -0,0 +1,274 @@
+// Copyright (c) 2021 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package minfs
+
+import (
+	"context"
+	"fmt"
+	"mime"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/minio/minfs/meta"
+	minio "github.com/minio/minio-go/v7"
+)
+
+// POSIX attributes are stored as user metadata of the object, using the same
+// headers as s3fs and rclone: mode is the decimal st_mode (octal when it has
+// a leading zero), times are seconds since the epoch with an optional
+// fraction.
+const (
+	metaMode  = "Mode"
+	metaUID   = "Uid"
+	metaGID   = "Gid"
+	metaMtime = "Mtime"
+	metaAtime = "Atime"
+)
+
+// normalizeMetadata returns the user metadata keyed by canonical name without
+// the X-Amz-Meta- prefix, listings and stats differ in which they return.
+func normalizeMetadata(md map[string]string) map[string]string {
+	n := make(map[string]string, len(md))
+	for k, v := range md {
+		if len(k) > len("X-Amz-Meta-") && strings.EqualFold(k[:len("X-Amz-Meta-")], "X-Amz-Meta-") {
+			k = k[len("X-Amz-Meta-"):]
+		}
+		n[canonicalMetaKey(k)] = v
+	}
+	return n
+}
+
+func canonicalMetaKey(k string) string {
+	parts := strings.Split(strings.ToLower(k), "-")
+	for i, p := range parts {
+		if p != "" {
+			parts[i] = strings.ToUpper(p[:1]) + p[1:]
+		}
+	}
+	return strings.Join(parts, "-")
+}
+
+// unixMode converts a file mode to st_mode of a regular file.
+func unixMode(mode os.FileMode) uint32 {
+	m := uint32(mode.Perm()) | syscall.S_IFREG
+	if mode&os.ModeSetuid != 0 {
+		m |= syscall.S_ISUID
+	}
+	if mode&os.ModeSetgid != 0 {
+		m |= syscall.S_ISGID
+	}
+	if mode&os.ModeSticky != 0 {
+		m |= syscall.S_ISVTX
+	}
+	return m
+}
+
+// fileMode converts the permission bits of st_mode to a file mode.
+func fileMode(m uint32) os.FileMode {
+	mode := os.FileMode(m & 0777)
+	if m&syscall.S_ISUID != 0 {
+		mode |= os.ModeSetuid
+	}
+	if m&syscall.S_ISGID != 0 {
+		mode |= os.ModeSetgid
+	}
+	if m&syscall.S_ISVTX != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode
+}
+
+func formatMetaTime(t time.Time) string {
+	return fmt.Sprintf("%d.%09d", t.Unix(), t.Nanosecond())
+}
+
+func parseMetaTime(s string) (time.Time, error) {
+	parts := strings.SplitN(s, ".", 2)
+
+	sec, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	var nsec int64
+	if len(parts) == 2 && parts[1] != "" {
+		frac := (parts[1] + "000000000")[:9]
+		if nsec, err = strconv.ParseInt(frac, 10, 64); err != nil {
+			return time.Time{}, err
+		}
+	}
+
+	return time.Unix(sec, nsec).UTC(), nil
+}
+
+// userMetadata returns the user metadata for uploading the file, the POSIX
+// attributes on top of the user metadata set before its upload.
+func (f *File) userMetadata() map[string]string {
+	md := map[string]string{}
+	for k, v := range f.Metadata {
+		md[k] = v
+	}
+
+	md[metaMode] = strconv.FormatUint(uint64(unixMode(f.Mode)), 10)
+	md[metaUID] = strconv.FormatUint(uint64(f.UID), 10)
+	md[metaGID] = strconv.FormatUint(uint64(f.GID), 10)
+	md[metaMtime] = formatMetaTime(f.Mtime)
+	md[metaAtime] = formatMetaTime(f.Atime)
+	return md
+}
+
+// applyUserMetadata updates the POSIX attributes of the file from the user
+// metadata of its object, invalid values are ignored.
+func (f *File) applyUserMetadata(md map[string]string) {
+	md = normalizeMetadata(md)
+
+	if v, ok := md[metaMode]; ok {
+		base := 10
+		if strings.HasPrefix(v, "0") {
+			base = 8
+		}
+		if m, err := strconv.ParseUint(v, base, 32); err == nil {
+			f.Mode = fileMode(uint32(m))
+		}
+	}
+
+	if v, ok := md[metaUID]; ok {
+		if uid, err := strconv.ParseUint(v, 10, 32); err == nil {
+			f.UID = uint32(uid)
+		}
+	}
+
+	if v, ok := md[metaGID]; ok {
+		if gid, err := strconv.ParseUint(v, 10, 32); err == nil {
+			f.GID = uint32(gid)
+		}
+	}
+
+	if v, ok := md[metaMtime]; ok {
+		if t, err := parseMetaTime(v); err == nil {
+			f.Mtime = t
+		}
+	}
+
+	if v, ok := md[metaAtime]; ok {
+		if t, err := parseMetaTime(v); err == nil {
+			f.Atime = t
+		}
+	}
+}
+
+// storeMetadata stores the POSIX attributes of the file in the user metadata
+// of its object.
+func (f *File) storeMetadata(ctx context.Context) error {
+	posix := f.userMetadata()
+	return f.updateMetadata(ctx, func(md map[string]string) {
+		for _, k := range []string{metaMode, metaUID, metaGID, metaMtime, metaAtime} {
+			md[k] = posix[k]
+		}
+	})
+}
+
+// updateMetadata applies fn to the user metadata of the object, other user
+// metadata is preserved. Pending uploads are updated in place, uploaded
+// objects with a metadata-only copy, and files not uploaded yet keep the
+// changes till their upload.
+func (f *File) updateMetadata(ctx context.Context, fn func(map[string]string)) error {
+	mfs := f.mfs
+	target := f.RemotePath()
+
+	var pending bool
+	if err := mfs.db.Update(func(tx *meta.Tx) (err error) {
+		pending, err = mfs.updatePendingMetadata(tx, target, fn)
+		return err
+	}); err != nil {
+		return err
+	} else if pending {
+		return nil
+	}
+
+	objInfo, err := mfs.statObject(ctx, target)
+	if meta.IsNoSuchObject(err) {
+		if f.Metadata == nil {
+			f.Metadata = map[string]string{}
+		}
+		fn(f.Metadata)
+
+		return mfs.db.Update(func(tx *meta.Tx) error {
+			return f.store(tx)
+		})
+	} else if err != nil {
+		return err
+	}
+
+	metadata := normalizeMetadata(objInfo.UserMetadata)
+	fn(metadata)
+	metadata["Content-Type"] = objInfo.ContentType
+
+	sr := newCopyOp(ctx, target, target, metadata)
+	if err = mfs.sync(&sr); err != nil {
+		return err
+	}
+
+	if err = sr.wait(); err != nil {
+		return err
+	}
+
+	// the copy may have changed the ETag
+	f.ETag = sr.ETag
+	mfs.written(target, objInfo.ETag, sr.ETag)
+	return mfs.db.Update(func(tx *meta.Tx) error {
+		return f.store(tx)
+	})
+}
+
+// uploadOptions returns the options for uploading target, the user metadata
+// and tags of the current object being replaced are preserved underneath the
+// given ones. New objects have no current object.
+func (mfs *MinFS) uploadOptions(ctx context.Context, target string, current *minio.ObjectInfo, metadata, tags map[string]string) (minio.PutObjectOptions, error) {
+	opts := minio.PutObjectOptions{
+		ContentType:  mime.TypeByExtension(filepath.Ext(target)),
+		UserMetadata: map[string]string{},
+		UserTags:     map[string]string{},
+	}
+
+	if current != nil {
+		for k, v := range normalizeMetadata(current.UserMetadata) {
+			opts.UserMetadata[k] = v
+		}
+
+		if current.UserTagCount > 0 {
+			t, err := mfs.objectTags(ctx, target)
+			if err != nil {
+				return opts, err
+			}
+			for k, v := range t {
+				opts.UserTags[k] = v
+			}
+		}
+	}
+
+	for k, v := range metadata {
+		opts.UserMetadata[k] = v
+	}
+	for k, v := range tags {
+		opts.UserTags[k] = v
+	}
+	return opts, nil
+}
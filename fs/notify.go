@@ -0,0 +1,219 @@
+// Copyright (c) 2021 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package minfs
+
+import (
+	"context"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"bazil.org/fuse"
+	"github.com/minio/minfs/meta"
+	minio "github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/notification"
+)
+
+// listenerRetryInterval is the delay before reconnecting a failed listener.
+const listenerRetryInterval = 30 * time.Second
+
+// startListener subscribes to the notifications of the mounted bucket and
+// prefix, and applies the changes made by other clients to the cache.
+func (mfs *MinFS) startListener() {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-mfs.listenerDoneCh
+		cancel()
+	}()
+
+	prefix := mfs.config.basePath
+	if prefix != "" {
+		prefix = prefix + "/"
+	}
+
+	events := []string{
+		string(notification.ObjectCreatedAll),
+		string(notification.ObjectRemovedAll),
+	}
+
+	go func() {
+		for {
+			for info := range mfs.api.ListenBucketNotification(ctx, mfs.config.bucket, prefix, "", events) {
+				if info.Err != nil {
+					if code := minio.ToErrorResponse(info.Err).Code; code == "APINotSupported" || code == "NotImplemented" {
+						mfs.log.Println("Bucket notifications are not supported, metadata is refreshed by scanning only.")
+						return
+					}
+					mfs.log.Println("Error while listening for bucket notifications.", info.Err)
+					continue
+				}
+
+				for _, event := range info.Records {
+					if err := mfs.applyEvent(ctx, event); err != nil {
+						mfs.log.Println("Unable to apply bucket notification.", err)
+					}
+				}
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(listenerRetryInterval):
+			}
+		}
+	}()
+}
+
+// applyEvent updates the cached entry of the object in the event, when its
+// directory is cached, and invalidates the kernel entry.
+func (mfs *MinFS) applyEvent(ctx context.Context, event notification.Event) error {
+	key, err := url.QueryUnescape(event.S3.Object.Key)
+	if err != nil {
+		return err
+	}
+
+	if mfs.config.basePath != "" {
+		if !strings.HasPrefix(key, mfs.config.basePath+"/") {
+			return nil
+		}
+		key = key[len(mfs.config.basePath)+1:]
+	}
+
+	if mfs.internalObject(key) {
+		return nil
+	}
+
+	created := strings.HasPrefix(event.EventName, "s3:ObjectCreated:")
+
+	// directory markers, removed ones are picked up by scanning
+	marker := strings.HasSuffix(key, "/")
+	if marker {
+		key = strings.TrimSuffix(key, "/")
+		if key == "" || !created {
+			return nil
+		}
+	}
+
+	modTime, err := time.Parse(time.RFC3339, event.EventTime)
+	if err != nil {
+		modTime = time.Now().UTC()
+	}
+
+	objInfo := minio.ObjectInfo{
+		Key:          key,
+		Size:         event.S3.Object.Size,
+		ETag:         event.S3.Object.ETag,
+		LastModified: modTime,
+		UserMetadata: event.S3.Object.UserMetadata,
+	}
+
+	// events without the user metadata would store symbolic links as
+	// empty files and reset the attributes
+	if created && !marker && objInfo.UserMetadata == nil {
+		info, err := mfs.statObject(ctx, path.Join(mfs.config.basePath, key))
+		if meta.IsNoSuchObject(err) {
+			// removed since, applied by its own event
+			return nil
+		} else if err != nil {
+			return err
+		}
+		objInfo.UserMetadata = info.UserMetadata
+	}
+
+	var (
+		parent *Dir
+		name   string
+	)
+
+	if err = mfs.db.Update(func(tx *meta.Tx) error {
+		parts := strings.Split(key, "/")
+
+		dir := mfs.rootDir()
+		for _, part := range parts[:len(parts)-1] {
+			b := dir.bucket(tx)
+
+			var subdir Dir
+			if err := b.Get(part, &subdir); meta.IsNoSuchObject(err) {
+				if !created {
+					return nil
+				}
+
+				// a new directory, its contents are scanned on lookup
+				parent, name = dir, part
+				return dir.storeDir(b, tx, part, objInfo)
+			} else if err != nil {
+				return err
+			}
+
+			subdir.mfs = mfs
+			subdir.dir = dir
+			dir = &subdir
+		}
+
+		parent, name = dir, parts[len(parts)-1]
+
+		b := dir.bucket(tx)
+		if marker {
+			return dir.storeDir(b, tx, name, objInfo)
+		} else if created {
+			if target, ok := symlinkTarget(objInfo.UserMetadata); ok {
+				return dir.storeSymlink(b, tx, name, target, objInfo)
+			}
+			return dir.storeFile(b, tx, name, objInfo)
+		}
+
+		// not uploaded yet in write-back mode
+		if _, ok := lookupPending(tx, path.Join(mfs.config.basePath, key)); ok {
+			parent = nil
+			return nil
+		}
+
+		var o interface{}
+		if err := b.Get(name, &o); meta.IsNoSuchObject(err) {
+			return nil
+		} else if err != nil {
+			return err
+		} else if _, ok := o.(Dir); ok {
+			return nil
+		}
+
+		return b.Delete(name)
+	}); err != nil {
+		return err
+	}
+
+	if parent != nil {
+		mfs.invalidateEntry(parent.Inode, name)
+	}
+	return nil
+}
+
+// invalidateEntry invalidates the kernel cache of the entry name in the
+// directory with inode, if the directory is known to the kernel.
+func (mfs *MinFS) invalidateEntry(inode uint64, name string) {
+	mfs.m.Lock()
+	dir, ok := mfs.nodes[inode]
+	mfs.m.Unlock()
+
+	if !ok || mfs.server == nil {
+		return
+	}
+
+	if err := mfs.server.InvalidateEntry(dir, name); err != nil && err != fuse.ErrNotCached {
+		mfs.log.Println("Unable to invalidate entry.", err)
+	}
+}
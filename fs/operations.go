@@ -15,9 +15,70 @@
 
 package minfs
 
+import (
+	"context"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+)
+
 // Operation -
 type Operation struct {
 	Error chan error
+
+	// context of the request the operation is run for, the operation is
+	// aborted when the request is interrupted.
+	ctx context.Context
+}
+
+func newOperation(ctx context.Context) *Operation {
+	return &Operation{
+		// buffered, the worker never waits for an abandoned operation
+		Error: make(chan error, 1),
+		ctx:   ctx,
+	}
+}
+
+// wait returns the result of the operation, EINTR when the request is
+// interrupted first. The operation is aborted once it is run then.
+func (op *Operation) wait() error {
+	select {
+	case err := <-op.Error:
+		return err
+	case <-op.ctx.Done():
+		return fuse.EINTR
+	}
+}
+
+// context returns the context the operation is run with, limited to timeout
+// if set.
+func (op *Operation) context(timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout > 0 {
+		return context.WithTimeout(op.ctx, timeout)
+	}
+	return context.WithCancel(op.ctx)
+}
+
+// result maps the error of an operation aborted by ctx to an errno.
+func (op *Operation) result(ctx context.Context, err error) error {
+	return ctxErrno(ctx, err)
+}
+
+// ctxErrno maps err to EINTR or ETIMEDOUT when ctx has been canceled or has
+// expired.
+func ctxErrno(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	switch ctx.Err() {
+	case context.Canceled:
+		return fuse.EINTR
+	case context.DeadlineExceeded:
+		return fuse.Errno(syscall.ETIMEDOUT)
+	}
+	return err
 }
 
 // MoveOperation - Move source object to target object. Copy source to target, delete the source.
@@ -28,13 +89,11 @@ type MoveOperation struct {
 	Target string
 }
 
-func newMoveOp(sourcePath, targetPath string) MoveOperation {
+func newMoveOp(ctx context.Context, sourcePath, targetPath string) MoveOperation {
 	return MoveOperation{
-		Source: sourcePath,
-		Target: targetPath,
-		Operation: &Operation{
-			Error: make(chan error),
-		},
+		Source:    sourcePath,
+		Target:    targetPath,
+		Operation: newOperation(ctx),
 	}
 }
 
@@ -44,6 +103,21 @@ type CopyOperation struct {
 
 	Source string
 	Target string
+
+	// replaces the user metadata of the target if set
+	Metadata map[string]string
+
+	// ETag of the copied object
+	ETag string
+}
+
+func newCopyOp(ctx context.Context, sourcePath, targetPath string, metadata map[string]string) CopyOperation {
+	return CopyOperation{
+		Source:    sourcePath,
+		Target:    targetPath,
+		Metadata:  metadata,
+		Operation: newOperation(ctx),
+	}
 }
 
 // PutOperation - Copy source file to target.
@@ -54,15 +128,34 @@ type PutOperation struct {
 
 	Source string
 	Target string
+
+	// user metadata and tags of the uploaded object
+	Metadata map[string]string
+	Tags     map[string]string
+
+	// conditional uploads require the target to still have the ETag
+	// Match, an empty Match requires it not to exist. Otherwise the data
+	// is uploaded to the conflict copy Conflict instead.
+	Conditional bool
+	Match       string
+	Conflict    string
+
+	// the first Base bytes of the source outside of the Dirty ranges are
+	// unchanged from the object with the ETag Match.
+	Base  int64
+	Dirty []byteRange
+
+	// ETag of the uploaded object
+	ETag string
 }
 
-func newPutOp(sourcePath string, targetPath string, length int64) PutOperation {
+func newPutOp(ctx context.Context, sourcePath string, targetPath string, length int64, metadata, tags map[string]string) PutOperation {
 	return PutOperation{
-		Source: sourcePath,
-		Target: targetPath,
-		Length: int64(length),
-		Operation: &Operation{
-			Error: make(chan error),
-		},
+		Source:    sourcePath,
+		Target:    targetPath,
+		Length:    int64(length),
+		Metadata:  metadata,
+		Tags:      tags,
+		Operation: newOperation(ctx),
 	}
 }
@@ -0,0 +1,178 @@
+// Copyright (c) 2021 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package minfs
+
+import (
+	"context"
+	"io"
+	"os"
+
+	minio "github.com/minio/minio-go/v7"
+)
+
+// Objects of at least partialUploadMinSize are updated with a multipart
+// upload, the parts untouched since the object was opened are copied from
+// it on the server and only the modified ones are uploaded.
+const (
+	partialUploadMinSize = 64 << 20
+	partialPartSize      = 16 << 20
+	maxParts             = 10000
+)
+
+// byteRange is the range [start, end) of a file.
+type byteRange struct {
+	Start int64
+	End   int64
+}
+
+// addRange adds [start, end) to the sorted ranges, merging overlapping and
+// adjacent ones.
+func addRange(ranges []byteRange, start, end int64) []byteRange {
+	if start >= end {
+		return ranges
+	}
+
+	var result []byteRange
+	for _, r := range ranges {
+		switch {
+		case r.End < start:
+			result = append(result, r)
+		case end < r.Start:
+			if start < end {
+				result = append(result, byteRange{start, end})
+				start, end = 0, 0
+			}
+			result = append(result, r)
+		default:
+			if r.Start < start {
+				start = r.Start
+			}
+			if r.End > end {
+				end = r.End
+			}
+		}
+	}
+
+	if start < end {
+		result = append(result, byteRange{start, end})
+	}
+	return result
+}
+
+// overlapsRange returns if any of the ranges overlaps [start, end).
+func overlapsRange(ranges []byteRange, start, end int64) bool {
+	for _, r := range ranges {
+		if r.Start < end && start < r.End {
+			return true
+		}
+	}
+	return false
+}
+
+// copySourceError is returned by partUpload when a part can't be copied
+// from the object, e.g. as it has been replaced or removed since. These
+// uploads are done in full instead.
+type copySourceError struct {
+	err error
+}
+
+func (e copySourceError) Error() string {
+	return e.err.Error()
+}
+
+// partialUpload returns if the upload is done with partUpload.
+func (req *PutOperation) partialUpload() bool {
+	return req.Conflict == "" && req.Match != "" && req.Base >= partialUploadMinSize
+}
+
+// partUpload builds the target from the unchanged parts of the object it
+// was opened from, copied on the server, and the modified parts of the
+// source. The copies require the object to still have the ETag Match.
+func (mfs *MinFS) partUpload(ctx context.Context, req *PutOperation, opts minio.PutObjectOptions) error {
+	core := mfs.core()
+
+	partSize := int64(partialPartSize)
+	for req.Length > partSize*maxParts {
+		partSize *= 2
+	}
+
+	r, err := os.Open(req.Source)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	var uploadID string
+	if err = mfs.retry(ctx, func() (err error) {
+		uploadID, err = core.NewMultipartUpload(ctx, mfs.config.bucket, req.Target, opts)
+		return err
+	}); err != nil {
+		return err
+	}
+
+	abort := func(cause error) error {
+		if err := core.AbortMultipartUpload(context.Background(), mfs.config.bucket, req.Target, uploadID); err != nil {
+			mfs.log.Println("Unable to abort partial upload.", err)
+		}
+		return cause
+	}
+
+	var parts []minio.CompletePart
+	var uploaded int64
+	for start := int64(0); start < req.Length; start += partSize {
+		end := start + partSize
+		if end > req.Length {
+			end = req.Length
+		}
+
+		partID := len(parts) + 1
+
+		var part minio.CompletePart
+		if end <= req.Base && !overlapsRange(req.Dirty, start, end) {
+			err = mfs.retry(ctx, func() (err error) {
+				part, err = core.CopyObjectPart(ctx, mfs.config.bucket, req.Target, mfs.config.bucket, req.Target, uploadID, partID, start, end-start, map[string]string{
+					"x-amz-copy-source-if-match": req.Match,
+				})
+				return err
+			})
+			if err != nil && ctx.Err() == nil {
+				err = copySourceError{err}
+			}
+		} else {
+			err = mfs.retry(ctx, func() error {
+				p, err := core.PutObjectPart(ctx, mfs.config.bucket, req.Target, uploadID, partID, io.NewSectionReader(r, start, end-start), end-start, "", "", nil)
+				part = minio.CompletePart{PartNumber: p.PartNumber, ETag: p.ETag}
+				return err
+			})
+			uploaded += end - start
+		}
+		if err != nil {
+			return abort(err)
+		}
+
+		parts = append(parts, part)
+	}
+
+	if err = mfs.retry(ctx, func() (err error) {
+		req.ETag, err = core.CompleteMultipartUpload(ctx, mfs.config.bucket, req.Target, uploadID, parts, minio.PutObjectOptions{})
+		return err
+	}); err != nil {
+		return abort(err)
+	}
+
+	mfs.log.Printf("Partial upload finished: %s -> %s, %d of %d bytes uploaded.\n", req.Source, req.Target, uploaded, req.Length)
+	return nil
+}
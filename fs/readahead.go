@@ -0,0 +1,159 @@
+// Copyright (c) 2021 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package minfs
+
+import (
+	"context"
+	"sync"
+)
+
+// readahead tracks the read pattern of a handle reading through the block
+// cache. Once reads are sequential the blocks of the readahead window after
+// the read are fetched concurrently into the block cache.
+type readahead struct {
+	m sync.Mutex
+
+	// end of the previous read, and the number of sequential reads
+	next   int64
+	streak int
+
+	// blocks up to this index have been prefetched already, the ones
+	// still being fetched are closed when done.
+	prefetched int64
+	inflight   map[int64]chan struct{}
+
+	// stops the prefetches when the handle is released, which waits for
+	// them to return
+	ctx     context.Context
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+	stopped bool
+}
+
+// readahead records a read of [offset, offset+size) and prefetches the
+// blocks following it when reading sequentially.
+func (fh *FileHandle) readahead(offset, size int64) {
+	mfs := fh.f.mfs
+
+	window := (mfs.config.readahead + blockSize - 1) / blockSize
+	if window == 0 || size <= 0 {
+		return
+	}
+
+	ra := &fh.ra
+	ra.m.Lock()
+	defer ra.m.Unlock()
+
+	if ra.stopped {
+		return
+	}
+
+	_, last := blockRange(offset, size)
+	if offset != ra.next {
+		// random access, a new streak starts
+		ra.next = offset + size
+		ra.streak = 0
+		ra.prefetched = last
+		return
+	}
+
+	ra.next = offset + size
+	if ra.streak++; ra.streak < 2 {
+		ra.prefetched = last
+		return
+	}
+
+	if ra.ctx == nil {
+		ra.ctx, ra.cancel = context.WithCancel(context.Background())
+		ra.inflight = map[int64]chan struct{}{}
+	}
+
+	lastBlock := (int64(fh.f.Size) - 1) / blockSize
+	if ra.prefetched < last {
+		ra.prefetched = last
+	}
+
+	for ; ra.prefetched < last+window && ra.prefetched < lastBlock; ra.prefetched++ {
+		idx := ra.prefetched + 1
+		if mfs.cache.Contains(fh.cacheKey, idx) {
+			continue
+		}
+
+		done := make(chan struct{})
+		ra.inflight[idx] = done
+		ra.wg.Add(1)
+		go fh.prefetch(ra.ctx, idx, done)
+	}
+}
+
+// prefetch fetches the block into the block cache.
+func (fh *FileHandle) prefetch(ctx context.Context, idx int64, done chan struct{}) {
+	mfs := fh.f.mfs
+
+	defer func() {
+		fh.ra.m.Lock()
+		delete(fh.ra.inflight, idx)
+		fh.ra.m.Unlock()
+		close(done)
+		fh.ra.wg.Done()
+	}()
+
+	data, err := fh.f.fetchRange(ctx, idx*blockSize, (idx+1)*blockSize)
+	if err != nil {
+		if ctx.Err() == nil {
+			mfs.log.Println("Unable to prefetch block.", err)
+		}
+		return
+	}
+
+	if len(data) == 0 {
+		return
+	}
+
+	if err := mfs.cache.Put(fh.cacheKey, idx, data); err != nil {
+		mfs.log.Println("Unable to cache block.", err)
+	}
+}
+
+// waitPrefetch waits for the prefetch of the block, if any, so it isn't
+// fetched twice.
+func (fh *FileHandle) waitPrefetch(ctx context.Context, idx int64) {
+	fh.ra.m.Lock()
+	done := fh.ra.inflight[idx]
+	fh.ra.m.Unlock()
+
+	if done == nil {
+		return
+	}
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+}
+
+// stopReadahead aborts the prefetches of the handle and waits for them, so
+// none outlives the handle.
+func (fh *FileHandle) stopReadahead() {
+	fh.ra.m.Lock()
+	fh.ra.stopped = true
+	if fh.ra.cancel != nil {
+		fh.ra.cancel()
+	}
+	fh.ra.m.Unlock()
+
+	fh.ra.wg.Wait()
+}
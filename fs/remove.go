@@ -0,0 +1,191 @@
+// Copyright (c) 2021 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package minfs
+
+import (
+	"context"
+	"path"
+	"strings"
+	"syscall"
+
+	"bazil.org/fuse"
+	"github.com/minio/minfs/meta"
+	minio "github.com/minio/minio-go/v7"
+)
+
+// xattrRemoveAll is the control attribute of a directory which removes the
+// entry named by its value with all its contents, e.g.
+//
+//	setfattr -n user.minfs.remove_all -v build /mnt/bucket/project
+const xattrRemoveAll = "user.minfs.remove_all"
+
+// removeObject removes the object.
+func (mfs *MinFS) removeObject(ctx context.Context, object string) error {
+	return mfs.retry(ctx, func() error {
+		return mfs.api.RemoveObject(ctx, mfs.config.bucket, object, minio.RemoveObjectOptions{})
+	})
+}
+
+// undoObject removes the object created for a cache update that failed.
+func (mfs *MinFS) undoObject(object string) {
+	if err := mfs.removeObject(context.Background(), object); err != nil {
+		mfs.log.Printf("Unable to remove %s after a failed cache update: %s.\n", object, err)
+	}
+}
+
+// hasPendingBelow returns if there are pending uploads below prefix.
+func hasPendingBelow(tx *meta.Tx, prefix string) (found bool) {
+	writebackBucket(tx).ForEach(func(k string, o interface{}) error {
+		if pu, ok := o.(PendingUpload); ok && strings.HasPrefix(pu.Target, prefix+"/") {
+			found = true
+		}
+		return nil
+	})
+	return found
+}
+
+// checkEmpty returns ENOTEMPTY when there are objects below prefix other than
+// its directory marker, the bucket is checked as the cache may be stale.
+func (mfs *MinFS) checkEmpty(ctx context.Context, prefix string) error {
+	var pending bool
+	mfs.db.View(func(tx *meta.Tx) error {
+		pending = hasPendingBelow(tx, prefix)
+		return nil
+	})
+	if pending {
+		return fuse.Errno(syscall.ENOTEMPTY)
+	}
+
+	// the listing stops at the first object
+	return mfs.listObjects(ctx, minio.ListObjectsOptions{
+		Prefix:    prefix + "/",
+		Recursive: true,
+	}, func(objInfo minio.ObjectInfo) error {
+		if objInfo.Key != prefix+"/" {
+			return fuse.Errno(syscall.ENOTEMPTY)
+		}
+		return nil
+	})
+}
+
+// removePrefix removes the objects below prefix in batches, failed attempts
+// are retried by listing the remaining objects again.
+func (mfs *MinFS) removePrefix(ctx context.Context, prefix string) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	listErrCh := make(chan error, 1)
+	objectsCh := make(chan minio.ObjectInfo)
+
+	go func() {
+		defer close(objectsCh)
+
+		for objInfo := range mfs.api.ListObjects(ctx, mfs.config.bucket, minio.ListObjectsOptions{
+			Prefix:    prefix + "/",
+			Recursive: true,
+		}) {
+			if objInfo.Err != nil {
+				listErrCh <- objInfo.Err
+				return
+			}
+
+			select {
+			case objectsCh <- objInfo:
+			case <-ctx.Done():
+				listErrCh <- ctx.Err()
+				return
+			}
+		}
+		listErrCh <- nil
+	}()
+
+	// the results are drained so the removal finishes
+	var err error
+	for rerr := range mfs.api.RemoveObjects(ctx, mfs.config.bucket, objectsCh, minio.RemoveObjectsOptions{}) {
+		if rerr.Err != nil && err == nil {
+			err = rerr.Err
+			cancel()
+		}
+	}
+
+	if lerr := <-listErrCh; err == nil {
+		err = lerr
+	}
+	return err
+}
+
+// Setxattr handles the control attributes of the directory.
+func (dir *Dir) Setxattr(ctx context.Context, req *fuse.SetxattrRequest) error {
+	if req.Name != xattrRemoveAll {
+		return fuse.ENOTSUP
+	}
+
+	name := string(req.Xattr)
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		return fuse.Errno(syscall.EINVAL)
+	}
+
+	if err := dir.mfs.wait(path.Join(dir.FullPath(), name)); err != nil {
+		return err
+	}
+
+	if err := dir.mfs.db.View(func(tx *meta.Tx) error {
+		var o interface{}
+		if err := dir.bucket(tx).Get(name, &o); meta.IsNoSuchObject(err) {
+			return fuse.ENOENT
+		} else if err != nil {
+			return err
+		} else if _, ok := o.(Dir); !ok {
+			return fuse.Errno(syscall.ENOTDIR)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	// the objects are removed outside of a transaction, so the cache can
+	// be updated meanwhile.
+	prefix := path.Join(dir.RemotePath(), name)
+	if err := dir.mfs.retry(ctx, func() error {
+		return dir.mfs.removePrefix(ctx, prefix)
+	}); err != nil {
+		return err
+	}
+
+	var dropped []string
+	if err := dir.mfs.db.Update(func(tx *meta.Tx) (err error) {
+		if dropped, err = dir.mfs.dropPendingBelow(writebackBucket(tx), prefix); err != nil {
+			return err
+		}
+
+		b := dir.bucket(tx)
+		if err = b.Delete(name); err != nil {
+			return err
+		}
+
+		b.DeleteBucket(name + "/")
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	removeStaged(dropped)
+	dir.mfs.log.Printf("Removed %s recursively.\n", prefix)
+
+	// the kernel holds the directory lock till this request returns
+	go dir.mfs.invalidateEntry(dir.Inode, name)
+	return nil
+}
@@ -0,0 +1,309 @@
+// Copyright (c) 2021 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package minfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/minio/minfs/meta"
+	minio "github.com/minio/minio-go/v7"
+)
+
+// renameWorkers is the number of objects moved in parallel when renaming a
+// directory.
+const renameWorkers = 16
+
+// renameRetryAttempts is the number of attempts of a rename continued in
+// the background.
+const renameRetryAttempts = 10
+
+// RenameJournal - a directory rename in progress. The objects below Source
+// are recorded before they are moved, so an interrupted rename is rolled
+// forward on the next start.
+type RenameJournal struct {
+	Source string
+	Target string
+
+	// all objects below Source have been recorded
+	Listed bool
+}
+
+// RenameObject - an object of a journaled directory rename.
+type RenameObject struct {
+	Key  string
+	Done bool
+}
+
+// renameBucket is the cache database bucket containing the rename journals,
+// the objects of each journal are kept in a sub-bucket of the same name.
+func renameBucket(tx *meta.Tx) *meta.Bucket {
+	return tx.Bucket("renames/")
+}
+
+// moveObject copies source to target and removes source.
+func (mfs *MinFS) moveObject(ctx context.Context, source, target string) error {
+	if _, err := mfs.copyObject(ctx, source, target, nil); err != nil {
+		return err
+	}
+	return mfs.retry(ctx, func() error {
+		return mfs.api.RemoveObject(ctx, mfs.config.bucket, source, minio.RemoveObjectOptions{})
+	})
+}
+
+// journalRename records the rename of the directory source to target in the
+// transaction, pending uploads below source follow to target.
+func (mfs *MinFS) journalRename(tx *meta.Tx, source, target string) (string, error) {
+	b := renameBucket(tx)
+
+	id := nextSuffix()
+	for b.Get(id, &RenameJournal{}) == nil {
+		id = nextSuffix()
+	}
+
+	if _, err := b.CreateBucketIfNotExists(id + "/"); err != nil {
+		return "", err
+	}
+
+	if err := b.Put(id, &RenameJournal{Source: source, Target: target}); err != nil {
+		return "", err
+	}
+
+	wb := writebackBucket(tx)
+
+	pending := map[string]PendingUpload{}
+	if err := wb.ForEach(func(k string, o interface{}) error {
+		if pu, ok := o.(PendingUpload); ok && strings.HasPrefix(pu.Target, source+"/") {
+			pu.Target = target + pu.Target[len(source):]
+			pending[k] = pu
+		}
+		return nil
+	}); err != nil {
+		return "", err
+	}
+
+	for k, pu := range pending {
+		if err := wb.Put(k, &pu); err != nil {
+			return "", err
+		}
+	}
+
+	return id, nil
+}
+
+// runRename moves the objects of the journaled rename id, the journal is
+// removed once all objects have been moved.
+func (mfs *MinFS) runRename(ctx context.Context, id string) error {
+	var j RenameJournal
+	if err := mfs.db.View(func(tx *meta.Tx) error {
+		return renameBucket(tx).Get(id, &j)
+	}); err != nil {
+		return err
+	}
+
+	if !j.Listed {
+		if err := mfs.listRename(ctx, id, &j); err != nil {
+			return err
+		}
+	}
+
+	todo := map[string]RenameObject{}
+	if err := mfs.db.View(func(tx *meta.Tx) error {
+		return renameBucket(tx).Bucket(id + "/").ForEach(func(k string, o interface{}) error {
+			if ro, ok := o.(RenameObject); ok && !ro.Done {
+				todo[k] = ro
+			}
+			return nil
+		})
+	}); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type job struct {
+		k  string
+		ro RenameObject
+	}
+
+	jobCh := make(chan job)
+	errCh := make(chan error, renameWorkers)
+
+	var wg sync.WaitGroup
+	for i := 0; i < renameWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for jb := range jobCh {
+				target := j.Target + jb.ro.Key[len(j.Source):]
+
+				// moved before the journal was updated
+				if err := mfs.moveObject(ctx, jb.ro.Key, target); err != nil && !meta.IsNoSuchObject(err) {
+					errCh <- err
+					cancel()
+					return
+				}
+
+				jb.ro.Done = true
+				if err := mfs.db.Update(func(tx *meta.Tx) error {
+					return renameBucket(tx).Bucket(id+"/").Put(jb.k, &jb.ro)
+				}); err != nil {
+					errCh <- err
+					cancel()
+					return
+				}
+			}
+		}()
+	}
+
+loop:
+	for k, ro := range todo {
+		select {
+		case jobCh <- job{k, ro}:
+		case <-ctx.Done():
+			break loop
+		}
+	}
+
+	close(jobCh)
+	wg.Wait()
+
+	select {
+	case err := <-errCh:
+		return err
+	default:
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if err := mfs.db.Update(func(tx *meta.Tx) error {
+		b := renameBucket(tx)
+		if err := b.DeleteBucket(id + "/"); err != nil {
+			return err
+		}
+		return b.Delete(id)
+	}); err != nil {
+		return err
+	}
+
+	mfs.log.Printf("Rename finished: %s -> %s.\n", j.Source, j.Target)
+	return nil
+}
+
+// listRename records all objects below the source of the journal, nothing
+// has been moved before this completes.
+func (mfs *MinFS) listRename(ctx context.Context, id string, j *RenameJournal) error {
+	var objects []RenameObject
+	if err := mfs.listObjects(ctx, minio.ListObjectsOptions{
+		Prefix:    j.Source + "/",
+		Recursive: true,
+	}, func(objInfo minio.ObjectInfo) error {
+		objects = append(objects, RenameObject{Key: objInfo.Key})
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return mfs.db.Update(func(tx *meta.Tx) error {
+		b := renameBucket(tx)
+		ob := b.Bucket(id + "/")
+
+		for i := range objects {
+			// object keys may end with a slash, which is reserved
+			if err := ob.Put(fmt.Sprintf("%016x", i), &objects[i]); err != nil {
+				return err
+			}
+		}
+
+		j.Listed = true
+		return b.Put(id, j)
+	})
+}
+
+// resumeRenames rolls forward the renames interrupted by a previous run.
+func (mfs *MinFS) resumeRenames() error {
+	var ids []string
+	if err := mfs.db.View(func(tx *meta.Tx) error {
+		return renameBucket(tx).ForEach(func(k string, o interface{}) error {
+			ids = append(ids, k)
+			return nil
+		})
+	}); err != nil {
+		return err
+	}
+
+	if len(ids) > 0 {
+		mfs.log.Printf("Resuming %d interrupted renames.\n", len(ids))
+	}
+
+	go func() {
+		for _, id := range ids {
+			mfs.retryRename(id)
+		}
+	}()
+
+	return nil
+}
+
+// renameRetryable returns if the rename failed with a transient error or was
+// interrupted, it is continued in the background then.
+func renameRetryable(ctx context.Context, err error) bool {
+	return ctx.Err() != nil || errors.Is(err, context.Canceled) || retryable(err)
+}
+
+// retryRename runs the journaled rename id till it succeeds, fails
+// permanently, runs out of attempts or the file system is shut down. Its
+// journal is kept and resumed on the next start.
+func (mfs *MinFS) retryRename(id string) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		select {
+		case <-mfs.doneCh:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	for attempt := 1; ; attempt++ {
+		err := mfs.runRename(ctx, id)
+		if err == nil || ctx.Err() != nil {
+			return
+		}
+
+		if !retryable(err) || attempt >= renameRetryAttempts {
+			mfs.log.Printf("Rename is stuck, journal %s is kept till the next start: %s.\n", id, err)
+			return
+		}
+
+		mfs.log.Printf("Rename failed, retrying in %s: %s.\n", writebackRetryInterval, err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(writebackRetryInterval):
+		}
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright (c) 2021 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package minfs
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	minio "github.com/minio/minio-go/v7"
+)
+
+// maxRetryBackoff caps the delay between two attempts.
+const maxRetryBackoff = 30 * time.Second
+
+// retryable returns if err is a transient error of the server or network,
+// which is worth another attempt.
+func retryable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	resp := minio.ToErrorResponse(err)
+	switch resp.Code {
+	case "SlowDown", "ServiceUnavailable", "InternalError", "RequestTimeout", "OperationAborted", "XMinioServerNotInitialized":
+		return true
+	}
+
+	switch resp.StatusCode {
+	case http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout, http.StatusTooManyRequests:
+		return true
+	}
+
+	// syscall.Errno implements net.Error as well, only errors of network
+	// requests are matched so local errors aren't retried.
+	var opErr *net.OpError
+	var urlErr *url.Error
+	if errors.As(err, &opErr) || errors.As(err, &urlErr) {
+		return true
+	}
+
+	var pathErr *os.PathError
+	var linkErr *os.LinkError
+	if errors.As(err, &pathErr) || errors.As(err, &linkErr) {
+		return false
+	}
+
+	return errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.EPIPE)
+}
+
+// errno maps S3 errors to the matching errno, other errors are returned as
+// is and reported as EIO.
+func errno(err error) error {
+	switch minio.ToErrorResponse(err).Code {
+	case "AccessDenied", "AllAccessDisabled", "InvalidAccessKeyId", "SignatureDoesNotMatch":
+		return fuse.Errno(syscall.EACCES)
+	case "NoSuchBucket":
+		return fuse.ENOENT
+	case "SlowDown":
+		return fuse.Errno(syscall.EAGAIN)
+	case "EntityTooLarge":
+		return fuse.Errno(syscall.EFBIG)
+	}
+	return err
+}
+
+// retry runs fn till it succeeds, fails permanently or the configured
+// attempts are exhausted, with exponential backoff between the attempts. The
+// retries of minio-go itself are disabled on mount, so retryAttempts is the
+// total number of attempts.
+func (mfs *MinFS) retry(ctx context.Context, fn func() error) error {
+	backoff := mfs.config.retryBackoff
+
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || !retryable(err) || attempt >= mfs.config.retryAttempts {
+			return errno(err)
+		}
+
+		mfs.log.Printf("Attempt %d failed, retrying in %s: %s.\n", attempt, backoff, err)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+
+		if backoff *= 2; backoff > maxRetryBackoff {
+			backoff = maxRetryBackoff
+		}
+	}
+}
+
+// statObject returns the info of the object.
+func (mfs *MinFS) statObject(ctx context.Context, object string) (objInfo minio.ObjectInfo, err error) {
+	err = mfs.retry(ctx, func() (err error) {
+		objInfo, err = mfs.api.StatObject(ctx, mfs.config.bucket, object, minio.StatObjectOptions{})
+		return err
+	})
+	return objInfo, err
+}
+
+// listObjects calls fn for the objects of the listing, a listing failing
+// midway is continued after the last object.
+func (mfs *MinFS) listObjects(ctx context.Context, opts minio.ListObjectsOptions, fn func(minio.ObjectInfo) error) error {
+	return mfs.retry(ctx, func() error {
+		// stops the listing when returning early
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		for objInfo := range mfs.api.ListObjects(ctx, mfs.config.bucket, opts) {
+			if objInfo.Err != nil {
+				return objInfo.Err
+			}
+
+			if err := fn(objInfo); err != nil {
+				return err
+			}
+			opts.StartAfter = objInfo.Key
+		}
+		return nil
+	})
+}
@@ -0,0 +1,235 @@
+// Copyright (c) 2021 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package minfs
+
+import (
+	"context"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/minio/minfs/meta"
+	minio "github.com/minio/minio-go/v7"
+)
+
+// metaSymlink is the user metadata key holding the target of a symbolic
+// link, the target is path escaped as metadata is sent as http headers.
+const metaSymlink = "Symlink-Target"
+
+// Symlink implements Node for symbolic links, which are stored as empty
+// objects with their target in the user metadata.
+type Symlink struct {
+	mfs *MinFS
+
+	dir *Dir
+
+	Path  string
+	Inode uint64
+
+	Target string
+
+	ETag string
+
+	Atime time.Time
+	Mtime time.Time
+
+	UID uint32
+	GID uint32
+
+	Chgtime time.Time
+	Crtime  time.Time
+}
+
+// symlinkTarget returns the target of the symbolic link described by the
+// user metadata of an object.
+func symlinkTarget(md map[string]string) (string, bool) {
+	v, ok := normalizeMetadata(md)[metaSymlink]
+	if !ok {
+		return "", false
+	}
+
+	target, err := url.PathUnescape(v)
+	if err != nil {
+		return "", false
+	}
+	return target, true
+}
+
+func (l *Symlink) store(tx *meta.Tx) error {
+	b := l.dir.bucket(tx)
+	return b.Put(path.Base(l.Path), l)
+}
+
+// Attr returns the attributes of the symbolic link
+func (l *Symlink) Attr(ctx context.Context, a *fuse.Attr) error {
+	*a = fuse.Attr{
+		Inode:  l.Inode,
+		Size:   uint64(len(l.Target)),
+		Atime:  l.Atime,
+		Mtime:  l.Mtime,
+		Ctime:  l.Chgtime,
+		Crtime: l.Crtime,
+		Mode:   os.ModeSymlink | 0777,
+		Uid:    l.UID,
+		Gid:    l.GID,
+		Valid:  l.mfs.config.dirTTL,
+	}
+
+	return nil
+}
+
+// Readlink returns the target of the symbolic link
+func (l *Symlink) Readlink(ctx context.Context, req *fuse.ReadlinkRequest) (string, error) {
+	return l.Target, nil
+}
+
+// RemotePath will return the full path on bucket
+func (l *Symlink) RemotePath() string {
+	return path.Join(l.dir.RemotePath(), l.Path)
+}
+
+// Dirent returns the Symlink object as a fuse.Dirent
+func (l *Symlink) Dirent() fuse.Dirent {
+	return fuse.Dirent{
+		Inode: l.Inode, Name: l.Path, Type: fuse.DT_Link,
+	}
+}
+
+// userMetadata returns the user metadata of the object of the symbolic link.
+func (l *Symlink) userMetadata() map[string]string {
+	return map[string]string{
+		metaSymlink: url.PathEscape(l.Target),
+		metaMode:    strconv.FormatUint(uint64(syscall.S_IFLNK|0777), 10),
+		metaUID:     strconv.FormatUint(uint64(l.UID), 10),
+		metaGID:     strconv.FormatUint(uint64(l.GID), 10),
+		metaMtime:   formatMetaTime(l.Mtime),
+	}
+}
+
+func (dir *Dir) storeSymlink(bucket *meta.Bucket, tx *meta.Tx, baseKey string, target string, objInfo minio.ObjectInfo) error {
+	var o interface{}
+	err := bucket.Get(baseKey, &o)
+	if l, ok := o.(Symlink); err == nil && ok {
+		// Symbolic link already exists, update values as needed.
+		l.dir = dir
+		l.mfs = dir.mfs
+		l.Target = target
+		l.ETag = objInfo.ETag
+		if objInfo.LastModified.After(l.Mtime) {
+			l.Mtime = objInfo.LastModified
+		}
+		return l.store(tx)
+	} else if err != nil && !meta.IsNoSuchObject(err) {
+		return err
+	}
+
+	// Not found or replacing a file, allocate a new inode.
+	seq, err := dir.mfs.NextSequence(tx)
+	if err != nil {
+		return err
+	}
+
+	md := normalizeMetadata(objInfo.UserMetadata)
+
+	l := Symlink{
+		dir:     dir,
+		Path:    baseKey,
+		Inode:   seq,
+		Target:  target,
+		ETag:    objInfo.ETag,
+		UID:     dir.mfs.config.uid,
+		GID:     dir.mfs.config.gid,
+		Chgtime: objInfo.LastModified,
+		Crtime:  objInfo.LastModified,
+		Mtime:   objInfo.LastModified,
+		Atime:   objInfo.LastModified,
+	}
+	if uid, err := strconv.ParseUint(md[metaUID], 10, 32); err == nil {
+		l.UID = uint32(uid)
+	}
+	if gid, err := strconv.ParseUint(md[metaGID], 10, 32); err == nil {
+		l.GID = uint32(gid)
+	}
+	if t, err := parseMetaTime(md[metaMtime]); err == nil {
+		l.Mtime = t
+	}
+	return l.store(tx)
+}
+
+// Symlink creates a symbolic link in current dir
+func (dir *Dir) Symlink(ctx context.Context, req *fuse.SymlinkRequest) (fs.Node, error) {
+	if err := dir.mfs.wait(path.Join(dir.FullPath(), req.NewName)); err != nil {
+		return nil, err
+	}
+
+	if err := dir.mfs.db.View(func(tx *meta.Tx) error {
+		var o interface{}
+		if err := dir.bucket(tx).Get(req.NewName, &o); err == nil {
+			return fuse.EEXIST
+		} else if !meta.IsNoSuchObject(err) {
+			return err
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	l := Symlink{
+		mfs: dir.mfs,
+		dir: dir,
+
+		Path:   req.NewName,
+		Target: req.Target,
+
+		UID: dir.mfs.config.uid,
+		GID: dir.mfs.config.gid,
+
+		Chgtime: time.Now().UTC(),
+		Crtime:  time.Now().UTC(),
+		Mtime:   time.Now().UTC(),
+		Atime:   time.Now().UTC(),
+	}
+
+	// the object is created before the transaction as it takes requests
+	// to the bucket.
+	if err := dir.mfs.retry(ctx, func() error {
+		info, err := dir.mfs.api.PutObject(ctx, dir.mfs.config.bucket, l.RemotePath(), strings.NewReader(""), 0, minio.PutObjectOptions{
+			UserMetadata: l.userMetadata(),
+		})
+		l.ETag = info.ETag
+		return err
+	}); err != nil {
+		return nil, err
+	}
+
+	if err := dir.mfs.db.Update(func(tx *meta.Tx) (err error) {
+		if l.Inode, err = dir.mfs.NextSequence(tx); err != nil {
+			return err
+		}
+		return l.store(tx)
+	}); err != nil {
+		dir.mfs.undoObject(l.RemotePath())
+		return nil, err
+	}
+
+	return &l, nil
+}
@@ -0,0 +1,120 @@
+// Copyright (c) 2021 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package minfs
+
+import "sync"
+
+// syncQueue holds the queued sync operations. Operations are run in order
+// per object, an operation is runnable when none of its objects is used by
+// a running or an earlier queued operation, so a slow operation only holds
+// back the operations on its own objects.
+type syncQueue struct {
+	m     sync.Mutex
+	cond  *sync.Cond
+	queue []interface{}
+
+	// objects of the running operations
+	busy map[string]int
+}
+
+func newSyncQueue() *syncQueue {
+	q := &syncQueue{
+		busy: map[string]int{},
+	}
+	q.cond = sync.NewCond(&q.m)
+	return q
+}
+
+// push queues the operation, it never blocks.
+func (q *syncQueue) push(req interface{}) {
+	q.m.Lock()
+	defer q.m.Unlock()
+
+	q.queue = append(q.queue, req)
+	q.cond.Broadcast()
+}
+
+// next waits for a runnable operation and marks its objects busy.
+func (q *syncQueue) next() interface{} {
+	q.m.Lock()
+	defer q.m.Unlock()
+
+	for {
+		if i := q.runnable(); i >= 0 {
+			req := q.queue[i]
+			q.queue = append(q.queue[:i], q.queue[i+1:]...)
+
+			for _, key := range syncKeys(req) {
+				q.busy[key]++
+			}
+			return req
+		}
+		q.cond.Wait()
+	}
+}
+
+// done releases the objects of the operation.
+func (q *syncQueue) done(req interface{}) {
+	q.m.Lock()
+	defer q.m.Unlock()
+
+	for _, key := range syncKeys(req) {
+		if q.busy[key]--; q.busy[key] <= 0 {
+			delete(q.busy, key)
+		}
+	}
+	q.cond.Broadcast()
+}
+
+// runnable returns the index of the first runnable operation, -1 if there is
+// none.
+func (q *syncQueue) runnable() int {
+	blocked := map[string]bool{}
+	for i, req := range q.queue {
+		keys := syncKeys(req)
+
+		free := true
+		for _, key := range keys {
+			if q.busy[key] > 0 || blocked[key] {
+				free = false
+			}
+		}
+		if free {
+			return i
+		}
+
+		// later operations on the same objects stay behind this one
+		for _, key := range keys {
+			blocked[key] = true
+		}
+	}
+	return -1
+}
+
+// syncKeys returns the objects an operation is ordered by, moves and copies
+// are ordered with the operations on both their source and target.
+func syncKeys(req interface{}) []string {
+	switch req := req.(type) {
+	case *MoveOperation:
+		return []string{req.Source, req.Target}
+	case *CopyOperation:
+		return []string{req.Source, req.Target}
+	case *PutOperation:
+		return []string{req.Target}
+	default:
+		panic("Unknown type")
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright (c) 2021 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package minfs
+
+import (
+	"context"
+	"syscall"
+
+	"bazil.org/fuse"
+)
+
+// truncate changes the size of the file. The cache file of a handle open for
+// writing is truncated or extended and uploaded when the handle is flushed,
+// closed files are opened for writing, truncated and uploaded right away.
+func (f *File) truncate(ctx context.Context, req *fuse.SetattrRequest) error {
+	size := int64(req.Size)
+
+	if fh := f.mfs.writableHandle(f); fh != nil {
+		if err := fh.truncate(size); err != nil {
+			return err
+		}
+		f.Size = req.Size
+		return nil
+	}
+
+	if req.Size == f.Size {
+		return nil
+	}
+
+	// truncating to zero doesn't need the current content
+	flags := fuse.OpenReadWrite
+	if size == 0 {
+		flags |= fuse.OpenTruncate
+	}
+
+	h, err := f.Open(ctx, &fuse.OpenRequest{Flags: flags}, &fuse.OpenResponse{})
+	if err != nil {
+		return err
+	}
+
+	fh := h.(*FileHandle)
+	defer fh.Release(ctx, &fuse.ReleaseRequest{})
+
+	if err = fh.truncate(size); err != nil {
+		return err
+	}
+
+	return fh.Flush(ctx, &fuse.FlushRequest{})
+}
+
+// writableHandle returns a handle the file is open for writing with, if any.
+// The handle of the request is a handle id of the fuse server and not ours.
+func (mfs *MinFS) writableHandle(f *File) *FileHandle {
+	for _, fh := range mfs.handles.list() {
+		if fh.f.Inode == f.Inode && fh.writable {
+			return fh
+		}
+	}
+	return nil
+}
+
+// truncate truncates or extends the cache file, extending it leaves a hole
+// which reads as zeros.
+func (fh *FileHandle) truncate(size int64) error {
+	fh.m.Lock()
+	defer fh.m.Unlock()
+
+	if fh.streamErr != nil {
+		return fh.streamErr
+	}
+
+	// data that has been streamed already can't be changed
+	if fh.streamed(size) {
+		return fuse.Errno(syscall.ESPIPE)
+	}
+
+	if err := fh.File.Truncate(size); err != nil {
+		return err
+	}
+
+	if fh.written > size {
+		fh.written = size
+	}
+
+	// the object is unchanged up to the new size at most
+	if fh.base > size {
+		fh.base = size
+	}
+
+	fh.f.Size = uint64(size)
+	fh.dirty = true
+	return nil
+}
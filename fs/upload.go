@@ -0,0 +1,205 @@
+// Copyright (c) 2021 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package minfs
+
+import (
+	"context"
+	"io"
+	"syscall"
+
+	"bazil.org/fuse"
+	minio "github.com/minio/minio-go/v7"
+)
+
+// streamPartSize is the initial size of the parts of a streaming upload. The
+// size of the object isn't known upfront, so the part size doubles every
+// streamPartGrowth parts up to maxStreamPartSize, which allows objects beyond
+// the 5TiB limit of S3 within 10000 parts.
+const (
+	streamPartSize    = 64 << 20
+	streamPartGrowth  = 1000
+	maxStreamPartSize = 4 << 30
+)
+
+// streamUpload is a multipart upload fed by sequential writes. Parts are
+// uploaded from the cache file as soon as they are complete, after which
+// their space in the cache file is released.
+type streamUpload struct {
+	uploadID string
+	parts    []minio.CompletePart
+
+	// data before offset has been uploaded
+	offset int64
+
+	// the upload has been completed, the handle can't be written anymore
+	done bool
+}
+
+func (mfs *MinFS) core() *minio.Core {
+	return &minio.Core{Client: mfs.api}
+}
+
+// streamParts uploads all complete parts of the sequentially written data,
+// the multipart upload is initiated with the first part.
+func (fh *FileHandle) streamParts(ctx context.Context) error {
+	mfs := fh.f.mfs
+
+	for fh.written-fh.streamOffset() >= fh.partSize() {
+		if fh.stream == nil {
+			// new files have nothing to preserve
+			var current *minio.ObjectInfo
+			if fh.etag != "" {
+				var err error
+				if current, err = mfs.currentObject(ctx, fh.f.RemotePath()); err != nil {
+					return err
+				}
+			}
+
+			opts, err := mfs.uploadOptions(ctx, fh.f.RemotePath(), current, fh.f.userMetadata(), fh.f.Tags)
+			if err != nil {
+				return err
+			}
+
+			var uploadID string
+			if err = mfs.retry(ctx, func() (err error) {
+				uploadID, err = mfs.core().NewMultipartUpload(ctx, mfs.config.bucket, fh.f.RemotePath(), opts)
+				return err
+			}); err != nil {
+				return err
+			}
+			fh.stream = &streamUpload{uploadID: uploadID}
+		}
+
+		size := fh.partSize()
+		if err := fh.uploadPart(ctx, size); err != nil {
+			return err
+		}
+
+		// the part is safe in the bucket, free its disk space
+		if err := punchHole(fh.File, fh.stream.offset-size, size); err != nil {
+			mfs.log.Println("Unable to release cache space.", err)
+		}
+	}
+
+	return nil
+}
+
+// partSize returns the size of the next part of the streaming upload.
+func (fh *FileHandle) partSize() int64 {
+	size := int64(streamPartSize)
+	if fh.stream == nil {
+		return size
+	}
+
+	for n := len(fh.stream.parts) / streamPartGrowth; n > 0 && size < maxStreamPartSize; n-- {
+		size *= 2
+	}
+	return size
+}
+
+func (fh *FileHandle) streamOffset() int64 {
+	if fh.stream == nil {
+		return 0
+	}
+	return fh.stream.offset
+}
+
+// uploadPart uploads the next part of size bytes from the cache file.
+func (fh *FileHandle) uploadPart(ctx context.Context, size int64) error {
+	mfs := fh.f.mfs
+
+	partID := len(fh.stream.parts) + 1
+	if partID > maxParts {
+		return fuse.Errno(syscall.EFBIG)
+	}
+
+	var part minio.ObjectPart
+	if err := mfs.retry(ctx, func() (err error) {
+		r := io.NewSectionReader(fh.File, fh.stream.offset, size)
+		part, err = mfs.core().PutObjectPart(ctx, mfs.config.bucket, fh.f.RemotePath(), fh.stream.uploadID, partID, r, size, "", "", nil)
+		return err
+	}); err != nil {
+		return err
+	}
+
+	fh.stream.parts = append(fh.stream.parts, minio.CompletePart{
+		PartNumber: part.PartNumber,
+		ETag:       part.ETag,
+	})
+	fh.stream.offset += size
+	return nil
+}
+
+// completeStream uploads the remaining data as the last parts and completes
+// the multipart upload.
+func (fh *FileHandle) completeStream(ctx context.Context) error {
+	mfs := fh.f.mfs
+
+	for size := int64(fh.f.Size); fh.stream.offset < size; {
+		n := size - fh.stream.offset
+		if n > fh.partSize() {
+			n = fh.partSize()
+		}
+		if err := fh.uploadPart(ctx, n); err != nil {
+			return err
+		}
+	}
+
+	var etag string
+	if err := mfs.retry(ctx, func() (err error) {
+		etag, err = mfs.core().CompleteMultipartUpload(ctx, mfs.config.bucket, fh.f.RemotePath(), fh.stream.uploadID, fh.stream.parts, minio.PutObjectOptions{})
+		return err
+	}); err != nil {
+		return err
+	}
+
+	fh.f.ETag = etag
+	fh.etag = etag
+	fh.f.Metadata, fh.f.Tags = nil, nil
+	fh.stream.done = true
+	mfs.log.Printf("Streaming upload finished: %s.\n", fh.f.RemotePath())
+	return nil
+}
+
+// abortStream aborts the multipart upload, the data already uploaded has been
+// released from the cache file, so the handle can't be uploaded anymore.
+func (fh *FileHandle) abortStream(cause error) error {
+	mfs := fh.f.mfs
+
+	if fh.stream == nil {
+		// nothing has been uploaded yet
+		return cause
+	}
+
+	if err := mfs.core().AbortMultipartUpload(context.Background(), mfs.config.bucket, fh.f.RemotePath(), fh.stream.uploadID); err != nil {
+		mfs.log.Println("Unable to abort streaming upload.", err)
+	}
+
+	mfs.log.Printf("Streaming upload aborted: %s: %s.\n", fh.f.RemotePath(), cause)
+
+	fh.stream = nil
+	fh.streamErr = fuse.EIO
+	return cause
+}
+
+// streamed returns if the range starting at offset is no longer available in
+// the cache file, because it has been streamed to the bucket.
+func (fh *FileHandle) streamed(offset int64) bool {
+	if fh.stream == nil {
+		return false
+	}
+	return fh.stream.done || offset < fh.stream.offset
+}
@@ -0,0 +1,433 @@
+// Copyright (c) 2021 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package minfs
+
+import (
+	"context"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/minio/minfs/meta"
+)
+
+// writebackRetryInterval is the delay before a failed upload is retried.
+const writebackRetryInterval = 30 * time.Second
+
+// PendingUpload - a closed file waiting to be uploaded in write-back mode.
+type PendingUpload struct {
+	// staged copy of the cache file
+	Source string
+	Target string
+	Length int64
+
+	Metadata map[string]string
+	Tags     map[string]string
+
+	// ETag of the target when the file was opened, uploads staged by
+	// earlier versions are unconditional.
+	Conditional bool
+	Match       string
+}
+
+// writebackBucket is the cache database bucket containing all pending
+// uploads keyed by the name of their staged copy.
+func writebackBucket(tx *meta.Tx) *meta.Bucket {
+	return tx.Bucket("writeback/")
+}
+
+// stage copies the cache file of the handle to the write-back directory and
+// records the pending upload, superseding older uploads of the same object.
+func (mfs *MinFS) stage(fh *FileHandle) error {
+	dir := path.Join(mfs.config.cache, "writeback")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	key := nextSuffix()
+	for {
+		if _, err := os.Stat(path.Join(dir, key)); os.IsNotExist(err) {
+			break
+		} else if err != nil {
+			return err
+		}
+		key = nextSuffix()
+	}
+
+	pu := PendingUpload{
+		Source: path.Join(dir, key),
+		Target: fh.f.RemotePath(),
+		Length: int64(fh.f.Size),
+
+		Metadata: fh.f.userMetadata(),
+		Tags:     fh.f.Tags,
+
+		Conditional: true,
+		Match:       fh.etag,
+	}
+
+	if err := copyFile(pu.Source, fh.File, pu.Length); err != nil {
+		os.Remove(pu.Source)
+		return err
+	}
+
+	var dropped []string
+	if err := mfs.db.Update(func(tx *meta.Tx) (err error) {
+		b := writebackBucket(tx)
+		if dropped, err = mfs.dropPending(b, pu.Target); err != nil {
+			return err
+		}
+
+		if err := b.Put(key, &pu); err != nil {
+			return err
+		}
+
+		// carried by the pending upload from now on
+		fh.f.Metadata, fh.f.Tags = nil, nil
+		return fh.f.store(tx)
+	}); err != nil {
+		os.Remove(pu.Source)
+		return err
+	}
+
+	removeStaged(dropped)
+
+	mfs.queueWriteback(key)
+	return nil
+}
+
+// queueWriteback hands the pending upload to the writeback goroutine without
+// blocking the caller, when the queue is full it is queued again later.
+func (mfs *MinFS) queueWriteback(key string) {
+	select {
+	case mfs.writebackCh <- key:
+	default:
+		time.AfterFunc(writebackRetryInterval, func() {
+			mfs.queueWriteback(key)
+		})
+	}
+}
+
+// copyFile copies length bytes of src to the new file dst and syncs it, so
+// it survives a crash.
+func copyFile(dst string, src *os.File, length int64) error {
+	w, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	if _, err = io.Copy(w, io.NewSectionReader(src, 0, length)); err != nil {
+		return err
+	}
+
+	return w.Sync()
+}
+
+// dropPending removes the pending uploads of target, it returns their staged
+// copies, which are removed with removeStaged once the transaction has been
+// committed.
+func (mfs *MinFS) dropPending(b *meta.Bucket, target string) ([]string, error) {
+	return mfs.dropPendingFunc(b, func(t string) bool {
+		return t == target
+	})
+}
+
+// dropPendingBelow removes the pending uploads below prefix, like
+// dropPending.
+func (mfs *MinFS) dropPendingBelow(b *meta.Bucket, prefix string) ([]string, error) {
+	return mfs.dropPendingFunc(b, func(t string) bool {
+		return strings.HasPrefix(t, prefix+"/")
+	})
+}
+
+func (mfs *MinFS) dropPendingFunc(b *meta.Bucket, match func(string) bool) ([]string, error) {
+	var keys, sources []string
+	if err := b.ForEach(func(k string, o interface{}) error {
+		if pu, ok := o.(PendingUpload); ok && match(pu.Target) {
+			keys = append(keys, k)
+			sources = append(sources, pu.Source)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	for _, k := range keys {
+		if err := b.Delete(k); err != nil {
+			return nil, err
+		}
+	}
+
+	return sources, nil
+}
+
+// removeStaged removes the staged copies of dropped uploads.
+func removeStaged(sources []string) {
+	for _, source := range sources {
+		os.Remove(source)
+	}
+}
+
+// retargetPending moves the pending uploads of source to target, it returns
+// if there were any.
+func (mfs *MinFS) retargetPending(tx *meta.Tx, source, target string) (bool, error) {
+	return mfs.updatePending(tx, source, func(pu *PendingUpload) {
+		pu.Target = target
+	})
+}
+
+// updatePendingMetadata applies fn to the user metadata of the pending
+// uploads of target, it returns if there were any.
+func (mfs *MinFS) updatePendingMetadata(tx *meta.Tx, target string, fn func(map[string]string)) (bool, error) {
+	return mfs.updatePending(tx, target, func(pu *PendingUpload) {
+		if pu.Metadata == nil {
+			pu.Metadata = map[string]string{}
+		}
+		fn(pu.Metadata)
+	})
+}
+
+// updatePendingTags applies fn to the tags of the pending uploads of target,
+// it returns if there were any.
+func (mfs *MinFS) updatePendingTags(tx *meta.Tx, target string, fn func(map[string]string)) (bool, error) {
+	return mfs.updatePending(tx, target, func(pu *PendingUpload) {
+		if pu.Tags == nil {
+			pu.Tags = map[string]string{}
+		}
+		fn(pu.Tags)
+	})
+}
+
+func (mfs *MinFS) updatePending(tx *meta.Tx, target string, fn func(*PendingUpload)) (bool, error) {
+	b := writebackBucket(tx)
+
+	pending := map[string]PendingUpload{}
+	if err := b.ForEach(func(k string, o interface{}) error {
+		if pu, ok := o.(PendingUpload); ok && pu.Target == target {
+			fn(&pu)
+			pending[k] = pu
+		}
+		return nil
+	}); err != nil {
+		return false, err
+	}
+
+	for k, pu := range pending {
+		if err := b.Put(k, &pu); err != nil {
+			return false, err
+		}
+	}
+
+	return len(pending) > 0, nil
+}
+
+// pendingSource returns the staged copy of the pending upload of target,
+// which is newer than the remote object.
+func (mfs *MinFS) pendingSource(target string) (source string, ok bool) {
+	mfs.db.View(func(tx *meta.Tx) error {
+		source, ok = lookupPending(tx, target)
+		return nil
+	})
+	return source, ok
+}
+
+func lookupPending(tx *meta.Tx, target string) (source string, ok bool) {
+	writebackBucket(tx).ForEach(func(k string, o interface{}) error {
+		if pu, found := o.(PendingUpload); found && pu.Target == target {
+			source, ok = pu.Source, true
+		}
+		return nil
+	})
+	return source, ok
+}
+
+// storeETag advances the cached file of target from the ETag from to the
+// ETag of its upload, files which aren't cached or have changed since are
+// left alone.
+func (mfs *MinFS) storeETag(tx *meta.Tx, target, from, to string) error {
+	key := target
+	if mfs.config.basePath != "" {
+		key = strings.TrimPrefix(key, mfs.config.basePath+"/")
+	}
+	parts := strings.Split(key, "/")
+
+	dir := mfs.rootDir()
+	for _, part := range parts[:len(parts)-1] {
+		var subdir Dir
+		if err := dir.bucket(tx).Get(part, &subdir); meta.IsNoSuchObject(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		subdir.mfs = mfs
+		subdir.dir = dir
+		dir = &subdir
+	}
+
+	var o interface{}
+	if err := dir.bucket(tx).Get(parts[len(parts)-1], &o); meta.IsNoSuchObject(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	f, ok := o.(File)
+	if !ok || f.ETag != from {
+		return nil
+	}
+
+	f.mfs = mfs
+	f.dir = dir
+	f.ETag = to
+	return f.store(tx)
+}
+
+// startWriteback uploads the pending uploads in the order they were staged,
+// starting with the ones left behind by a previous run.
+func (mfs *MinFS) startWriteback() error {
+	var keys []string
+	if err := mfs.db.View(func(tx *meta.Tx) error {
+		return writebackBucket(tx).ForEach(func(k string, o interface{}) error {
+			keys = append(keys, k)
+			return nil
+		})
+	}); err != nil {
+		return err
+	}
+
+	if len(keys) > 0 {
+		mfs.log.Printf("Replaying %d pending uploads.\n", len(keys))
+	}
+
+	go func() {
+		for _, key := range keys {
+			mfs.writebackCh <- key
+		}
+	}()
+
+	// as many uploads as sync workers, uploads of the same object run
+	// one after another.
+	for i := 0; i < mfs.config.uploadWorkers; i++ {
+		go func() {
+			for key := range mfs.writebackCh {
+				mfs.writeback(key)
+			}
+		}()
+	}
+
+	return nil
+}
+
+// busyTarget waits till no upload of target is running and marks it busy,
+// the returned func marks it done.
+func (mfs *MinFS) busyTarget(target string) func() {
+	for {
+		mfs.writebackM.Lock()
+		busy, ok := mfs.writebackBusy[target]
+		if !ok {
+			done := make(chan struct{})
+			mfs.writebackBusy[target] = done
+			mfs.writebackM.Unlock()
+
+			return func() {
+				mfs.writebackM.Lock()
+				delete(mfs.writebackBusy, target)
+				mfs.writebackM.Unlock()
+				close(done)
+			}
+		}
+		mfs.writebackM.Unlock()
+
+		<-busy
+	}
+}
+
+func (mfs *MinFS) writeback(key string) {
+	readPending := func(pu *PendingUpload) bool {
+		if err := mfs.db.View(func(tx *meta.Tx) error {
+			return writebackBucket(tx).Get(key, pu)
+		}); meta.IsNoSuchObject(err) {
+			// superseded or removed in the meantime
+			return false
+		} else if err != nil {
+			mfs.log.Println("Unable to read pending upload.", err)
+			return false
+		}
+		return true
+	}
+
+	var pu PendingUpload
+	if !readPending(&pu) {
+		return
+	}
+
+	// the upload running before may have advanced the ETag expected
+	defer mfs.busyTarget(pu.Target)()
+	if !readPending(&pu) {
+		return
+	}
+
+	sr := newPutOp(context.Background(), pu.Source, pu.Target, pu.Length, pu.Metadata, pu.Tags)
+	sr.Conditional, sr.Match = pu.Conditional, pu.Match
+	err := mfs.sync(&sr)
+	if err == nil {
+		err = sr.wait()
+	}
+	if err != nil && !os.IsNotExist(err) {
+		mfs.log.Printf("Upload of %s failed, retrying in %s: %s.\n", pu.Target, writebackRetryInterval, err)
+		time.AfterFunc(writebackRetryInterval, func() {
+			mfs.queueWriteback(key)
+		})
+		return
+	}
+
+	// uploads staged since expect the version just replaced
+	uploaded := err == nil && sr.Conflict == ""
+
+	if err := mfs.db.Update(func(tx *meta.Tx) error {
+		if err := writebackBucket(tx).Delete(key); err != nil {
+			return err
+		}
+
+		if !uploaded {
+			return nil
+		}
+
+		if _, err := mfs.updatePending(tx, pu.Target, func(p *PendingUpload) {
+			if p.Conditional && p.Match == pu.Match {
+				p.Match = sr.ETag
+			}
+		}); err != nil {
+			return err
+		}
+
+		// the next open doesn't take our upload for a change
+		return mfs.storeETag(tx, pu.Target, pu.Match, sr.ETag)
+	}); err != nil {
+		mfs.log.Println("Unable to remove pending upload.", err)
+		return
+	}
+
+	if uploaded {
+		mfs.written(pu.Target, pu.Match, sr.ETag)
+	}
+
+	os.Remove(pu.Source)
+}
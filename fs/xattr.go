@@ -0,0 +1,301 @@
+// Copyright (c) 2021 MinIO, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package minfs
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"syscall"
+
+	"bazil.org/fuse"
+	"github.com/minio/minfs/meta"
+	minio "github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/tags"
+)
+
+// Extended attributes in the user namespace are mapped to the user metadata
+// of the object, the ones below xattrTagPrefix to the object tags.
+const (
+	xattrUserPrefix = "user."
+	xattrTagPrefix  = "user.s3.tag."
+)
+
+// setxattr(2) flags
+const (
+	xattrCreate  = 1
+	xattrReplace = 2
+)
+
+// metadata keys used for POSIX attributes, these are not exposed as xattrs.
+var reservedMetadata = map[string]bool{
+	metaMode:  true,
+	metaUID:   true,
+	metaGID:   true,
+	metaMtime: true,
+	metaAtime: true,
+}
+
+// xattrKey returns the metadata or tag key of an xattr name.
+func xattrKey(name string) (key string, tag bool, err error) {
+	if strings.HasPrefix(name, xattrTagPrefix) {
+		key = name[len(xattrTagPrefix):]
+		if key == "" {
+			return "", false, fuse.Errno(syscall.EINVAL)
+		}
+		return key, true, nil
+	}
+
+	if !strings.HasPrefix(name, xattrUserPrefix) {
+		return "", false, fuse.ENOTSUP
+	}
+
+	// metadata keys are case-insensitive, only the lowercase names listed
+	// are accepted so two names can't refer to the same key
+	if name != strings.ToLower(name) {
+		return "", false, fuse.Errno(syscall.EINVAL)
+	}
+
+	key = canonicalMetaKey(name[len(xattrUserPrefix):])
+	if key == "" || reservedMetadata[key] {
+		return "", false, fuse.EPERM
+	}
+	return key, false, nil
+}
+
+// remoteXattrs fetches the user metadata or tags of the object, the ones not
+// uploaded yet are returned for new files.
+func (f *File) remoteXattrs(ctx context.Context, tag bool) (map[string]string, error) {
+	md, t, err := f.xattrs(ctx, tag)
+	if tag {
+		return t, err
+	}
+	return md, err
+}
+
+// xattrs fetches the user metadata of the object with a single stat, and its
+// tags if withTags is set.
+func (f *File) xattrs(ctx context.Context, withTags bool) (md, t map[string]string, err error) {
+	mfs := f.mfs
+	target := f.RemotePath()
+
+	if _, ok := mfs.pendingSource(target); ok {
+		var pu PendingUpload
+		err := mfs.db.View(func(tx *meta.Tx) error {
+			return writebackBucket(tx).ForEach(func(k string, o interface{}) error {
+				if p, ok := o.(PendingUpload); ok && p.Target == target {
+					pu = p
+				}
+				return nil
+			})
+		})
+		return normalizeMetadata(pu.Metadata), pu.Tags, err
+	}
+
+	objInfo, err := mfs.statObject(ctx, target)
+	if meta.IsNoSuchObject(err) {
+		return normalizeMetadata(f.Metadata), f.Tags, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	md = normalizeMetadata(objInfo.UserMetadata)
+	if !withTags || objInfo.UserTagCount == 0 {
+		return md, nil, nil
+	}
+
+	t, err = mfs.objectTags(ctx, target)
+	return md, t, err
+}
+
+// objectTags returns the tags of the object.
+func (mfs *MinFS) objectTags(ctx context.Context, object string) (map[string]string, error) {
+	var t *tags.Tags
+	if err := mfs.retry(ctx, func() (err error) {
+		t, err = mfs.api.GetObjectTagging(ctx, mfs.config.bucket, object, minio.GetObjectTaggingOptions{})
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	return t.ToMap(), nil
+}
+
+// updateTags applies fn to the tags of the object, like updateMetadata.
+func (f *File) updateTags(ctx context.Context, fn func(map[string]string)) error {
+	mfs := f.mfs
+	target := f.RemotePath()
+
+	var pending bool
+	if err := mfs.db.Update(func(tx *meta.Tx) (err error) {
+		pending, err = mfs.updatePendingTags(tx, target, fn)
+		return err
+	}); err != nil {
+		return err
+	} else if pending {
+		return nil
+	}
+
+	m := map[string]string{}
+
+	objInfo, err := mfs.statObject(ctx, target)
+	if meta.IsNoSuchObject(err) {
+		for k, v := range f.Tags {
+			m[k] = v
+		}
+		fn(m)
+
+		f.Tags = m
+		return mfs.db.Update(func(tx *meta.Tx) error {
+			return f.store(tx)
+		})
+	} else if err != nil {
+		return err
+	}
+
+	if objInfo.UserTagCount > 0 {
+		current, err := mfs.objectTags(ctx, target)
+		if err != nil {
+			return err
+		}
+		for k, v := range current {
+			m[k] = v
+		}
+	}
+	fn(m)
+
+	if len(m) == 0 {
+		return mfs.retry(ctx, func() error {
+			return mfs.api.RemoveObjectTagging(ctx, mfs.config.bucket, target, minio.RemoveObjectTaggingOptions{})
+		})
+	}
+
+	t, err := tags.NewTags(m, true)
+	if err != nil {
+		return fuse.Errno(syscall.EINVAL)
+	}
+	return mfs.retry(ctx, func() error {
+		return mfs.api.PutObjectTagging(ctx, mfs.config.bucket, target, t, minio.PutObjectTaggingOptions{})
+	})
+}
+
+// Listxattr lists the user metadata and tags of the object.
+func (f *File) Listxattr(ctx context.Context, req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) error {
+	md, t, err := f.xattrs(ctx, true)
+	if err != nil {
+		return err
+	}
+
+	var names []string
+	for k := range md {
+		if !reservedMetadata[k] {
+			names = append(names, xattrUserPrefix+strings.ToLower(k))
+		}
+	}
+	for k := range t {
+		names = append(names, xattrTagPrefix+k)
+	}
+
+	sort.Strings(names)
+	resp.Append(names...)
+	return nil
+}
+
+// Getxattr returns a user metadata value or tag of the object.
+func (f *File) Getxattr(ctx context.Context, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
+	key, tag, err := xattrKey(req.Name)
+	if err != nil {
+		return fuse.ErrNoXattr
+	}
+
+	m, err := f.remoteXattrs(ctx, tag)
+	if err != nil {
+		return err
+	}
+
+	v, ok := m[key]
+	if !ok {
+		return fuse.ErrNoXattr
+	}
+
+	resp.Xattr = []byte(v)
+	return nil
+}
+
+// Setxattr sets a user metadata value with a server-side copy or a tag of the
+// object.
+func (f *File) Setxattr(ctx context.Context, req *fuse.SetxattrRequest) error {
+	key, tag, err := xattrKey(req.Name)
+	if err != nil {
+		return err
+	}
+
+	// values are sent as http headers
+	value := string(req.Xattr)
+	for _, c := range value {
+		if c < ' ' || c > '~' {
+			return fuse.Errno(syscall.EINVAL)
+		}
+	}
+
+	if req.Flags&(xattrCreate|xattrReplace) != 0 {
+		m, err := f.remoteXattrs(ctx, tag)
+		if err != nil {
+			return err
+		}
+
+		_, exists := m[key]
+		if req.Flags&xattrCreate != 0 && exists {
+			return fuse.EEXIST
+		} else if req.Flags&xattrReplace != 0 && !exists {
+			return fuse.ErrNoXattr
+		}
+	}
+
+	set := func(m map[string]string) {
+		m[key] = value
+	}
+
+	if tag {
+		return f.updateTags(ctx, set)
+	}
+	return f.updateMetadata(ctx, set)
+}
+
+// Removexattr removes a user metadata value or tag of the object.
+func (f *File) Removexattr(ctx context.Context, req *fuse.RemovexattrRequest) error {
+	key, tag, err := xattrKey(req.Name)
+	if err != nil {
+		return err
+	}
+
+	m, err := f.remoteXattrs(ctx, tag)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := m[key]; !ok {
+		return fuse.ErrNoXattr
+	}
+
+	remove := func(m map[string]string) {
+		delete(m, key)
+	}
+
+	if tag {
+		return f.updateTags(ctx, remove)
+	}
+	return f.updateMetadata(ctx, remove)
+}